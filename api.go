@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// handleListJobs responds with all known jobs and their target hosts.
+func handleListJobs(context *gin.Context) {
+	SetLogLevel(context, log.DebugLevel)
+	context.JSON(http.StatusOK, gin.H{"jobs": listDatasets()})
+}
+
+// handleGetJob responds with the job and its target hosts, or 404 if the job is not known.
+func handleGetJob(context *gin.Context) {
+	SetLogLevel(context, log.DebugLevel)
+	job := context.MustGet(parameterKey).(Job)
+	info, found := describeDataset(job)
+	if !found {
+		context.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("job is not registered: %s", job.JobName)})
+		return
+	}
+	context.JSON(http.StatusOK, info)
+}
+
+// handlePutJob registers the job and, if TargetHost is set, the target host. Responds with 201 if the job or target
+// host is new and with 200 if it already existed, in which case the gauges keep their values.
+func handlePutJob(context *gin.Context) {
+	job := context.MustGet(parameterKey).(Job)
+	existed := isKnownTarget(job)
+	if err := registerJob(context, job); err != nil {
+		respondRegisterError(context, job, err)
+		return
+	}
+	status := http.StatusOK
+	if !existed {
+		status = http.StatusCreated
+	}
+	info, _ := describeDataset(job)
+	context.JSON(status, info)
+}
+
+// handleDeleteJob deletes all series of the job or, if TargetHost is set, only the series of the target host. Responds
+// with 204 regardless of whether the job existed.
+func handleDeleteJob(context *gin.Context) {
+	job := context.MustGet(parameterKey).(Job)
+	unregisterJob(context, job)
+	context.Status(http.StatusNoContent)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJobAPI(t *testing.T) {
+	defer func() {
+		job := Job{JobName: "tank/api"}
+		job.UnregisterMetric()
+	}()
+	r := SetupRouter()
+	do := func(method, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, query, nil))
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/v1/jobs/tank/api").Code)
+	w := do("PUT", "/api/v1/jobs/tank/api?TargetHost=remote")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), `"targets":["remote"]`)
+
+	do("GET", "/presnap/tank/api")
+	assert.Equal(t, http.StatusOK, do("PUT", "/api/v1/jobs/tank/api?TargetHost=remote").Code)
+	assert.EqualValues(t, 1, testutil.ToFloat64(preSnapMetric.WithLabelValues("tank/api")))
+	assert.EqualValues(t, 0, testutil.ToFloat64(postSnapMetric.WithLabelValues("tank/api")), "registering again must keep the values")
+	assert.Equal(t, http.StatusCreated, do("PUT", "/api/v1/jobs/tank/api?TargetHost=other").Code)
+
+	w = do("GET", "/api/v1/jobs")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Jobs []datasetInfo `json:"jobs"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	i := indexOfJob(list.Jobs, "tank/api")
+	require.GreaterOrEqual(t, i, 0)
+	assert.Equal(t, []string{"other", "remote"}, list.Jobs[i].Targets)
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/api/v1/jobs/tank/api?TargetHost=other").Code)
+	assert.False(t, preSendMetric.DeleteLabelValues("tank/api", "other"))
+	assert.True(t, isKnownTarget(Job{JobName: "tank/api", TargetHost: "remote"}))
+	assert.NotNil(t, gaugeValue(preSnapMetric, []string{"tank/api"}), "deleting a target host must keep the job")
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/api/v1/jobs/tank/api").Code)
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/api/v1/jobs/tank/api").Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/v1/jobs/tank/api").Code)
+	assert.Equal(t, http.StatusBadRequest, do("PUT", "/api/v1/jobs/").Code)
+}
+
+func TestJob_UnregisterMetric(t *testing.T) {
+	r := SetupRouter()
+	for _, query := range []string{"/presnap/cleanup", "/postsnap/cleanup", "/presend/cleanup?TargetHost=a",
+		"/postsend/cleanup?TargetHost=a", "/presend/cleanup?TargetHost=b"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", query, nil))
+	}
+
+	job := Job{JobName: "cleanup", TargetHost: "b"}
+	// presend, postsend, send state and 6 job phases of target host b.
+	assert.Equal(t, 9, job.UnregisterMetric())
+	assert.True(t, isKnownTarget(Job{JobName: "cleanup", TargetHost: "a"}))
+
+	job.TargetHost = ""
+	// presnap, postsnap, snapshot state, last snapshot, snapshot duration, 4 hook counters, 6 job phases, and presend,
+	// postsend, send state, last send, send duration and 6 job phases of target host a.
+	assert.Equal(t, 26, job.UnregisterMetric())
+	assert.False(t, isKnownDataset(job))
+	assert.Zero(t, job.UnregisterMetric())
+}
+
+func indexOfJob(jobs []datasetInfo, name string) int {
+	for i, job := range jobs {
+		if job.Job == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	identityKey = "identity"
+	// identityAnonymous is recorded if the caller could not be identified, e.g. outside the multi-tenant mode.
+	identityAnonymous = "anonymous"
+	// identityPeer is recorded for changes that have been replicated by another replica.
+	identityPeer = "peer"
+	// identitySystem is recorded for changes that have not been requested by a client, e.g. the eviction of series.
+	identitySystem = "system"
+
+	// AuditResultApplied is recorded for a hook that changed the gauges of a job.
+	AuditResultApplied = "applied"
+	// AuditResultIgnored is recorded for a hook that is older than the latest event of the job.
+	AuditResultIgnored = "ignored"
+	// AuditResultRejected is recorded for a hook or registration that has been rejected, e.g. by a limit.
+	AuditResultRejected = "rejected"
+	// AuditResultRegistered is recorded for a registered job.
+	AuditResultRegistered = "registered"
+	// AuditResultUnregistered is recorded for an unregistered job.
+	AuditResultUnregistered = "unregistered"
+	// AuditResultFailed is recorded for a failed registration or a post hook with a non-zero exit code.
+	AuditResultFailed = "failed"
+	// AuditResultSilenced is recorded for a job that has been silenced or unsilenced.
+	AuditResultSilenced = "silenced"
+	// AuditResultReplicated is recorded for a gauge that has been changed by another replica.
+	AuditResultReplicated = "replicated"
+	// AuditResultEvicted is recorded for a job or target host whose stale series have been evicted.
+	AuditResultEvicted = "evicted"
+)
+
+var (
+	// audit is nil unless an audit log is configured, in which case all changes of the monitoring state are recorded.
+	audit *AuditLog
+)
+
+type (
+	// AuditLog appends an entry for each change of the monitoring state to a JSON lines file, which is rotated by size.
+	AuditLog struct {
+		path       string
+		maxSize    int64
+		maxBackups int
+
+		mu   sync.Mutex
+		file *os.File
+		size int64
+	}
+	// AuditEntry records who changed which gauges of a job by which request.
+	AuditEntry struct {
+		Time       time.Time          `json:"time"`
+		RequestID  string             `json:"request_id,omitempty"`
+		ClientIP   string             `json:"client_ip,omitempty"`
+		Identity   string             `json:"identity"`
+		Method     string             `json:"method,omitempty"`
+		Route      string             `json:"route,omitempty"`
+		Result     string             `json:"result"`
+		Job        string             `json:"job"`
+		SourceHost string             `json:"source_host,omitempty"`
+		TargetHost string             `json:"target_host,omitempty"`
+		Snapshot   string             `json:"snapshot,omitempty"`
+		RunID      string             `json:"run_id,omitempty"`
+		ExitCode   int                `json:"exit_code,omitempty"`
+		Error      string             `json:"error,omitempty"`
+		Before     map[Phase]*float64 `json:"before"`
+		After      map[Phase]*float64 `json:"after"`
+	}
+)
+
+// NewAuditLog opens the audit log at the given path for appending. The file is rotated once it exceeds maxSize bytes,
+// keeping up to maxBackups rotated files. A maxSize of 0 disables rotation.
+func NewAuditLog(path string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	a := &AuditLog{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Record appends an entry for the given job to the audit log, taking the caller from the request. Does nothing if the
+// AuditLog is nil.
+func (a *AuditLog) Record(c *gin.Context, job Job, result string, before, after map[Phase]*float64) {
+	if a == nil {
+		return
+	}
+	identity := c.GetString(identityKey)
+	if identity == "" {
+		identity = identityAnonymous
+	}
+	entry := newAuditEntry(job, result, before, after)
+	entry.RequestID = c.GetString(requestIDKey)
+	entry.ClientIP = clientAddress(c)
+	entry.Identity = identity
+	entry.Method = c.Request.Method
+	entry.Route = c.FullPath()
+	if err := a.Write(entry); err != nil {
+		job.logger().WithError(err).Error("Could not write audit log.")
+	}
+}
+
+// RecordSystem appends an entry for the given job to the audit log for a change that has not been requested by a
+// client. Does nothing if the AuditLog is nil.
+func (a *AuditLog) RecordSystem(job Job, result string, before, after map[Phase]*float64) {
+	a.recordUnrequested(job, identitySystem, result, before, after)
+}
+
+// RecordPeer appends an entry for the given job to the audit log for a change of another replica that has been pulled
+// from the state backend. Does nothing if the AuditLog is nil.
+func (a *AuditLog) RecordPeer(job Job, result string, before, after map[Phase]*float64) {
+	a.recordUnrequested(job, identityPeer, result, before, after)
+}
+
+func (a *AuditLog) recordUnrequested(job Job, identity, result string, before, after map[Phase]*float64) {
+	if a == nil {
+		return
+	}
+	entry := newAuditEntry(job, result, before, after)
+	entry.Identity = identity
+	if err := a.Write(entry); err != nil {
+		job.logger().WithError(err).Error("Could not write audit log.")
+	}
+}
+
+func newAuditEntry(job Job, result string, before, after map[Phase]*float64) AuditEntry {
+	return AuditEntry{
+		Time:       time.Now(),
+		Result:     result,
+		Job:        job.JobName,
+		SourceHost: job.SourceHost,
+		TargetHost: job.TargetHost,
+		Snapshot:   job.Snapshot,
+		RunID:      job.RunID,
+		ExitCode:   job.ExitCode,
+		Error:      job.Error,
+		Before:     before,
+		After:      after,
+	}
+}
+
+// Write appends the entry as single line and rotates the file beforehand if the line would exceed the maximum size.
+func (a *AuditLog) Write(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// Close closes the file of the audit log.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotate renames the current file to path.1, shifting the existing backups by one and removing the oldest, and opens a
+// new file. a.mu has to be held.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if a.maxBackups < 1 {
+		if err := os.Remove(a.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return a.open()
+	}
+	_ = os.Remove(backupPath(a.path, a.maxBackups))
+	for i := a.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backupPath(a.path, i), backupPath(a.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(a.path, backupPath(a.path, 1)); err != nil {
+		return err
+	}
+	log.WithField("path", a.path).Debug("Rotated audit log.")
+	return a.open()
+}
+
+func backupPath(path string, index int) string {
+	return fmt.Sprintf("%s.%d", path, index)
+}
+
+// auditGauges returns the current values of the gauges of the job by phase, or nil for the gauges that do not exist.
+// The send gauges are only included if the job has a target host.
+func (p *Job) auditGauges() map[Phase]*float64 {
+	result := map[Phase]*float64{
+		PhasePreSnap:       gaugeValue(preSnapMetric, p.labelValues()),
+		PhasePostSnap:      gaugeValue(postSnapMetric, p.labelValues()),
+		gaugeSnapshotState: gaugeValue(snapshotStateMetric, p.labelValues()),
+	}
+	if p.TargetHost != "" {
+		result[PhasePreSend] = gaugeValue(preSendMetric, p.labelValues(p.TargetHost))
+		result[PhasePostSend] = gaugeValue(postSendMetric, p.labelValues(p.TargetHost))
+		result[gaugeSendState] = gaugeValue(sendStateMetric, p.labelValues(p.TargetHost))
+	}
+	return result
+}
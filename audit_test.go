@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	a, err := NewAuditLog(path, 200, 2)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, a.Write(AuditEntry{Job: "tank", Result: AuditResultApplied}))
+	}
+	require.NoError(t, a.Close())
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		require.NoError(t, err, name)
+		assert.LessOrEqual(t, info.Size(), int64(200), name)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "only maxBackups files are kept")
+}
+
+func TestAuditLog_Record(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+	a, err := NewAuditLog(path, 0, 0)
+	require.NoError(t, err)
+	audit = a
+	defer func() {
+		audit = nil
+		for _, vec := range metricVector {
+			vec.DeleteLabelValues("audited")
+			vec.DeleteLabelValues("audited", "remote")
+		}
+		forgetDataset(Job{JobName: "audited"})
+	}()
+
+	r := SetupRouter()
+	for _, query := range []string{"/register/audited?TargetHost=remote", "/postsend/audited?TargetHost=remote&RunID=run-1",
+		"/unregister/audited"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", query, nil))
+	}
+	require.NoError(t, a.Close())
+
+	entries := readAuditLog(t, path)
+	require.Len(t, entries, 3)
+
+	zero, one, done := 0.0, 1.0, 2.0
+	assert.Equal(t, AuditResultRegistered, entries[0].Result)
+	assert.Equal(t, "/register/*job", entries[0].Route)
+	assert.Equal(t, identityAnonymous, entries[0].Identity)
+	assert.Nil(t, entries[0].Before[PhasePostSend])
+	assert.Equal(t, &one, entries[0].After[PhasePostSend])
+	assert.Equal(t, &zero, entries[0].After[gaugeSendState])
+
+	assert.Equal(t, AuditResultApplied, entries[1].Result)
+	assert.Equal(t, "remote", entries[1].TargetHost)
+	assert.Equal(t, "run-1", entries[1].RunID)
+	assert.NotEmpty(t, entries[1].RequestID)
+	assert.NotEmpty(t, entries[1].ClientIP)
+	assert.Equal(t, &one, entries[1].After[PhasePostSend])
+	assert.Equal(t, &done, entries[1].After[gaugeSendState])
+
+	assert.Equal(t, AuditResultUnregistered, entries[2].Result)
+	assert.NotNil(t, entries[2].Before[PhasePostSnap])
+	assert.Nil(t, entries[2].After[PhasePostSnap])
+}
+
+func TestAuditLog_Record_WhenReplicatedOrEvicted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+	a, err := NewAuditLog(path, 0, 0)
+	require.NoError(t, err)
+	audit = a
+	state = NewStateStore(NewGossipStateBackend(nil, "secret"))
+	knownDatasetsMutex.Lock()
+	previous := knownDatasets
+	knownDatasets = make(map[string]map[string]*datasetSeries)
+	knownDatasetsMutex.Unlock()
+	job := Job{JobName: "replicated"}
+	defer func() {
+		audit = nil
+		state = nil
+		job.UnregisterMetric()
+		knownDatasetsMutex.Lock()
+		knownDatasets = previous
+		knownDatasetsMutex.Unlock()
+	}()
+
+	r := SetupRouter()
+	req := httptest.NewRequest("POST", "/state",
+		strings.NewReader(`[{"gauge":"presnap","labels":["replicated"],"value":1,"updated":"2020-01-01T00:00:00Z"}]`))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, rememberDataset(job))
+	evictSeries(time.Now().Add(time.Second))
+	require.NoError(t, a.Close())
+
+	entries := readAuditLog(t, path)
+	require.Len(t, entries, 2)
+	one := 1.0
+	assert.Equal(t, AuditResultReplicated, entries[0].Result)
+	assert.Equal(t, identityPeer, entries[0].Identity)
+	assert.Equal(t, "replicated", entries[0].Job)
+	assert.Nil(t, entries[0].Before[PhasePreSnap])
+	assert.Equal(t, &one, entries[0].After[PhasePreSnap])
+
+	assert.Equal(t, AuditResultEvicted, entries[1].Result)
+	assert.Equal(t, identitySystem, entries[1].Identity)
+	assert.Empty(t, entries[1].ClientIP)
+	assert.Equal(t, &one, entries[1].Before[PhasePreSnap])
+	assert.Nil(t, entries[1].After[PhasePreSnap])
+}
+
+func TestAuditLog_Record_WhenSynced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+	a, err := NewAuditLog(path, 0, 0)
+	require.NoError(t, err)
+	audit = a
+	s := NewStateStore(&recordingBackend{received: []StateEntry{
+		{Gauge: PhasePostSend, Labels: []string{"synced", "host"}, Value: 1, Updated: time.Now()},
+	}})
+	defer func() {
+		audit = nil
+		postSendMetric.DeleteLabelValues("synced", "host")
+	}()
+
+	s.Sync()
+	s.Sync()
+	require.NoError(t, a.Close())
+
+	entries := readAuditLog(t, path)
+	require.Len(t, entries, 1, "entries that are already known are not recorded again")
+	one := 1.0
+	assert.Equal(t, AuditResultReplicated, entries[0].Result)
+	assert.Equal(t, identityPeer, entries[0].Identity)
+	assert.Equal(t, "synced", entries[0].Job)
+	assert.Equal(t, "host", entries[0].TargetHost)
+	assert.Nil(t, entries[0].Before[PhasePostSend])
+	assert.Equal(t, &one, entries[0].After[PhasePostSend])
+}
+
+func readAuditLog(t *testing.T, path string) []AuditEntry {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	spoolSuffix    = ".json"
+	rejectedSuffix = ".rejected"
+)
+
+type (
+	// HookEvent is a hook call of the client, which is stored in the spool directory if it cannot be delivered.
+	HookEvent struct {
+		Phase     Phase             `json:"phase"`
+		Job       string            `json:"job"`
+		Params    map[string]string `json:"params"`
+		Timestamp time.Time         `json:"timestamp"`
+	}
+	// Client calls the hooks of an exporter. Events that cannot be delivered are written to the spool directory and
+	// replayed with their original timestamp later.
+	Client struct {
+		url      string
+		spoolDir string
+		client   *http.Client
+	}
+	// rejectedError is returned if the exporter rejected an event, so that retrying it is pointless.
+	rejectedError struct {
+		error
+	}
+)
+
+// NewClient creates a new Client. Spooling is disabled if spoolDir is empty.
+func NewClient(baseURL, spoolDir string, timeout time.Duration) *Client {
+	return &Client{
+		url:      strings.TrimSuffix(baseURL, "/"),
+		spoolDir: spoolDir,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// Deliver replays the spooled events and then sends the given event. If the exporter is unreachable, the event is
+// spooled instead. Returns an error only if the event could neither be delivered nor spooled, or if it was rejected.
+func (c *Client) Deliver(event HookEvent) error {
+	if _, err := c.Replay(); err != nil {
+		// Keep the order of events: If the spool cannot be emptied, this event has to wait as well.
+		log.WithError(err).Debug("Could not replay spooled events.")
+		return c.spool(event, err)
+	}
+	err := c.Send(event)
+	if _, rejected := err.(rejectedError); err == nil || rejected {
+		return err
+	}
+	return c.spool(event, err)
+}
+
+// Send sends the given event to the exporter.
+func (c *Client) Send(event HookEvent) error {
+	query := url.Values{}
+	for key, value := range event.Params {
+		query.Set(key, value)
+	}
+	query.Set("Timestamp", event.Timestamp.Format(time.RFC3339Nano))
+	u := fmt.Sprintf("%s/%s/%s?%s", c.url, event.Phase, strings.TrimPrefix(event.Job, "/"), query.Encode())
+	resp, err := c.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return rejectedError{fmt.Errorf("event rejected with status code %d: %s", resp.StatusCode, body)}
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// Replay sends all spooled events in the order they occurred. Delivered events are removed from the spool directory,
+// rejected events are renamed and kept for inspection. Stops at the first event that cannot be delivered.
+// Returns the number of delivered events.
+func (c *Client) Replay() (int, error) {
+	if c.spoolDir == "" {
+		return 0, nil
+	}
+	files, err := filepath.Glob(filepath.Join(c.spoolDir, "*"+spoolSuffix))
+	if err != nil {
+		return 0, err
+	}
+	// The file names start with the timestamp, so sorting them restores the order of the events.
+	sort.Strings(files)
+	delivered := 0
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return delivered, err
+		}
+		event := HookEvent{}
+		if err := json.Unmarshal(b, &event); err != nil {
+			log.WithField("file", file).WithError(err).Warn("Skipping invalid spooled event.")
+			_ = os.Rename(file, file+rejectedSuffix)
+			continue
+		}
+		err = c.Send(event)
+		if _, rejected := err.(rejectedError); rejected {
+			log.WithField("file", file).WithError(err).Warn("Spooled event has been rejected.")
+			_ = os.Rename(file, file+rejectedSuffix)
+			continue
+		}
+		if err != nil {
+			return delivered, err
+		}
+		if err := os.Remove(file); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+func (c *Client) spool(event HookEvent, cause error) error {
+	if c.spoolDir == "" {
+		return cause
+	}
+	if err := os.MkdirAll(c.spoolDir, 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	name := fmt.Sprintf("%020d-%s%s", event.Timestamp.UnixNano(), hex.EncodeToString(suffix), spoolSuffix)
+	// Write to a temporary file first, so that a concurrent replay never reads a partial event.
+	tmp := filepath.Join(c.spoolDir, "."+name)
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(c.spoolDir, name)); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"phase": event.Phase, "job": event.Job}).WithError(cause).Warn("Exporter unreachable, spooled event.")
+	return nil
+}
+
+// runHookCommand implements the "hook" subcommand, which calls a hook of the exporter and spools it if necessary.
+func runHookCommand(args []string) int {
+	flags := flag.NewFlagSet("hook", flag.ContinueOnError)
+	baseURL := flags.String("url", "http://localhost:8080", "Base URL of the exporter")
+	spoolDir := flags.String("spool.dir", "", "Directory to store events in while the exporter is unreachable. Empty disables spooling")
+	target := flags.String("target", "", "Target host of the send (presend/postsend)")
+	params := flags.StringSlice("param", []string{}, "Additional query parameters in the form key=value, e.g. SelfResetAfter=1h. Can be specified multiple times")
+	timeout := flags.Duration("timeout", 10*time.Second, "Timeout for a single request")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s hook [flags] <presnap|postsnap|presend|postsend> <pool/dataset>\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 || !validPhase(Phase(flags.Arg(0))) {
+		flags.Usage()
+		return 2
+	}
+	event := HookEvent{Phase: Phase(flags.Arg(0)), Job: flags.Arg(1), Params: map[string]string{}, Timestamp: time.Now()}
+	for _, pair := range *params {
+		arr := strings.SplitN(pair, "=", 2)
+		if len(arr) != 2 {
+			log.WithField("param", pair).Error("Invalid parameter, expected key=value.")
+			return 2
+		}
+		event.Params[arr[0]] = arr[1]
+	}
+	if *target != "" {
+		event.Params["TargetHost"] = *target
+	}
+	if err := NewClient(*baseURL, *spoolDir, *timeout).Deliver(event); err != nil {
+		log.WithError(err).Error("Could not deliver event.")
+		return 1
+	}
+	return 0
+}
+
+// runReplayCommand implements the "replay" subcommand, which delivers all spooled events.
+func runReplayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	baseURL := flags.String("url", "http://localhost:8080", "Base URL of the exporter")
+	spoolDir := flags.String("spool.dir", "", "Directory containing the spooled events")
+	timeout := flags.Duration("timeout", 10*time.Second, "Timeout for a single request")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *spoolDir == "" {
+		log.Error("Missing --spool.dir.")
+		return 2
+	}
+	delivered, err := NewClient(*baseURL, *spoolDir, *timeout).Replay()
+	logEvent := log.WithField("delivered", delivered)
+	if err != nil {
+		logEvent.WithError(err).Error("Could not replay all spooled events.")
+		return 1
+	}
+	logEvent.Info("Replayed spooled events.")
+	return 0
+}
+
+func validPhase(phase Phase) bool {
+	switch phase {
+	case PhasePreSnap, PhasePostSnap, PhasePreSend, PhasePostSend:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClient_Deliver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var received []*http.Request
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL, dir, time.Second)
+	first := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, c.Deliver(HookEvent{Phase: PhasePreSnap, Job: "tank/first", Timestamp: first}))
+	require.NoError(t, c.Deliver(HookEvent{Phase: PhasePostSnap, Job: "tank/first", Timestamp: first.Add(time.Minute)}))
+	spooled, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSuffix))
+	assert.Len(t, spooled, 2)
+
+	status = http.StatusOK
+	received = nil
+	require.NoError(t, c.Deliver(HookEvent{
+		Phase: PhasePreSend, Job: "tank/second", Params: map[string]string{"TargetHost": "host"}, Timestamp: first.Add(time.Hour),
+	}))
+	require.Len(t, received, 3)
+	assert.Equal(t, "/presnap/tank/first", received[0].URL.Path)
+	assert.Equal(t, "2021-01-01T00:00:00Z", received[0].URL.Query().Get("Timestamp"))
+	assert.Equal(t, "/postsnap/tank/first", received[1].URL.Path)
+	assert.Equal(t, "/presend/tank/second", received[2].URL.Path)
+	assert.Equal(t, "host", received[2].URL.Query().Get("TargetHost"))
+	spooled, _ = filepath.Glob(filepath.Join(dir, "*"))
+	assert.Empty(t, spooled)
+}
+
+func TestClient_Replay(t *testing.T) {
+	tests := []struct {
+		name              string
+		status            int
+		expectedDelivered int
+		expectedError     bool
+		expectedFiles     string
+	}{
+		{name: "GivenReachableExporter_ThenRemoveEvents", status: http.StatusOK, expectedDelivered: 2},
+		{name: "GivenUnavailableExporter_ThenKeepEvents", status: http.StatusBadGateway, expectedError: true, expectedFiles: "*" + spoolSuffix},
+		{name: "GivenRejectedEvents_ThenKeepAsRejected", status: http.StatusBadRequest, expectedFiles: "*" + rejectedSuffix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "spool")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			c := NewClient(server.URL, dir, time.Second)
+			for _, phase := range []Phase{PhasePreSnap, PhasePostSnap} {
+				require.NoError(t, c.spool(HookEvent{Phase: phase, Job: "tank", Timestamp: time.Now()}, nil))
+			}
+			delivered, err := c.Replay()
+			if tt.expectedError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedDelivered, delivered)
+			files, _ := filepath.Glob(filepath.Join(dir, "*"))
+			if tt.expectedFiles == "" {
+				assert.Empty(t, files)
+				return
+			}
+			matching, _ := filepath.Glob(filepath.Join(dir, tt.expectedFiles))
+			assert.Len(t, matching, 2)
+			assert.Equal(t, files, matching)
+		})
+	}
+}
+
+func TestClient_Deliver_WithoutSpool(t *testing.T) {
+	c := NewClient("http://127.0.0.1:1", "", time.Second)
+	assert.Error(t, c.Deliver(HookEvent{Phase: PhasePreSnap, Job: "tank", Timestamp: time.Now()}))
+}
+
+func Test_handleHook_Timestamp(t *testing.T) {
+	server := httptest.NewServer(SetupRouter())
+	defer server.Close()
+	defer func() {
+		for _, vec := range metricVector {
+			vec.DeleteLabelValues("timestamp")
+		}
+		lastSnapshotMetric.DeleteLabelValues("timestamp")
+	}()
+
+	at := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewClient(server.URL, "", time.Second)
+	require.NoError(t, c.Send(HookEvent{Phase: PhasePostSnap, Job: "timestamp", Timestamp: at}))
+	assert.EqualValues(t, at.Unix(), testutil.ToFloat64(lastSnapshotMetric.WithLabelValues("timestamp")))
+
+	resp, err := http.Get(server.URL + "/postsnap/timestamp?Timestamp=yesterday")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -3,9 +3,14 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
 	flag "github.com/spf13/pflag"
+	"log/syslog"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/spf13/viper"
@@ -13,6 +18,18 @@ import (
 	"time"
 )
 
+const (
+	requestIDKey    = "request_id"
+	requestIDHeader = "X-Request-Id"
+
+	// LogFormatterText logs human readable lines, colored on a terminal.
+	LogFormatterText = "text"
+	// LogFormatterJSON logs one JSON object per line.
+	LogFormatterJSON = "json"
+	// LogFormatterLogfmt logs key=value pairs without colors.
+	LogFormatterLogfmt = "logfmt"
+)
+
 func init() {
 	setupFlags()
 }
@@ -22,7 +39,11 @@ func SetupLogging() {
 
 	cfg := GetConfig()
 	log.SetOutput(os.Stdout)
-	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	formatter, err := newLogFormatter(cfg.Log.Formatter)
+	if err != nil {
+		log.WithField("error", err).Warn("Using text formatter.")
+	}
+	log.SetFormatter(formatter)
 	level, err := log.ParseLevel(cfg.Log.Level)
 	if err != nil {
 		log.WithField("error", err).Warn("Using info level.")
@@ -30,16 +51,97 @@ func SetupLogging() {
 	} else {
 		log.SetLevel(level)
 	}
+	if cfg.Log.Syslog != "" {
+		if err := addSyslogHook(cfg.Log.Syslog); err != nil {
+			log.WithError(err).Warn("Could not connect to syslog.")
+		}
+	}
+}
+
+// newLogFormatter returns the log formatter with the given name. Returns the text formatter along with an error if the
+// name is unknown.
+func newLogFormatter(name string) (log.Formatter, error) {
+	switch name {
+	case LogFormatterJSON:
+		return &log.JSONFormatter{}, nil
+	case LogFormatterLogfmt:
+		// Without colors, the text formatter writes key=value pairs.
+		return &log.TextFormatter{FullTimestamp: true, DisableColors: true}, nil
+	case LogFormatterText, "":
+		return &log.TextFormatter{FullTimestamp: true}, nil
+	default:
+		return &log.TextFormatter{FullTimestamp: true}, fmt.Errorf("unknown log formatter: %s", name)
+	}
+}
+
+// addSyslogHook sends all log entries to syslog in addition to the standard output. The address is either "local"
+// for the local syslog daemon (and journald), or a URL like udp://host:514 or tcp://host:514.
+func addSyslogHook(address string) error {
+	network, raddr := "", ""
+	if address != "local" {
+		u, err := url.Parse(address)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid syslog address, expected 'local' or a URL like udp://host:514: %s", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	hook, err := logrus_syslog.NewSyslogHook(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "znapzend-exporter")
+	if err != nil {
+		return err
+	}
+	log.AddHook(hook)
+	return nil
 }
 
 // CreateDefaultConfig creates a config map with the hardcoded internal defaults.
 func CreateDefaultConfig() ConfigMap {
 	return ConfigMap{
 		Log: LogMap{
-			Level: "info",
+			Level:     "info",
+			Formatter: LogFormatterText,
 		},
 		BindAddr: ":8080",
-		Jobs:     JobMap{},
+		Jobs: JobMap{
+			InitialState:  InitialStateDone,
+			ScheduleGrace: 15 * time.Minute,
+		},
+		RateLimit: RateLimitMap{
+			ClientBurst: 10,
+			JobBurst:    4,
+		},
+		Hooks: HooksMap{
+			MaxClockSkew:  5 * time.Minute,
+			ValidateNames: true,
+			RunTimeout:    24 * time.Hour,
+		},
+		Notify: NotifyMap{
+			Events:   []string{EventSendFailed, EventJobStuck, EventJobRecovered, EventRunFailed},
+			Retries:  3,
+			Backoff:  time.Second,
+			Timeout:  10 * time.Second,
+			Template: defaultNotifyTemplate,
+		},
+		Metrics: MetricsMap{
+			Namespace:    "znapzend",
+			DatasetLabel: "job",
+			LegacyGauges: true,
+		},
+		Tenants: TenantsMap{
+			Label: "source_host",
+		},
+		State: StateMap{
+			Interval: 10 * time.Second,
+		},
+		Audit: AuditMap{
+			MaxSize:    100,
+			MaxBackups: 5,
+		},
+		Push: PushMap{
+			Mode:     PushModePushgateway,
+			Interval: 30 * time.Second,
+			Job:      "znapzend",
+			Timeout:  10 * time.Second,
+		},
 	}
 }
 
@@ -47,8 +149,65 @@ func setupFlags() {
 	cfg := CreateDefaultConfig()
 
 	flag.String("bindAddr", cfg.BindAddr, "IP Address to bind to listen for Prometheus scrapes")
+	flag.StringSlice("trustedProxies", []string{}, "Addresses or networks of reverse proxies whose X-Forwarded-For header is trusted to identify clients. Can be specified multiple times")
 	flag.String("log.level", cfg.Log.Level, "Logging level")
+	flag.String("log.formatter", cfg.Log.Formatter, "Format of the log output, either 'text', 'json' or 'logfmt'")
+	flag.String("log.syslog", cfg.Log.Syslog, "Additionally send logs to syslog, either 'local' or a URL like udp://host:514. Empty disables syslog")
 	flag.StringSlice("jobs.register", []string{}, "A list of job labels to register at startup. Can be specified multiple times")
+	flag.String("jobs.initialState", cfg.Jobs.InitialState, "State of the gauges of registered jobs until the first hook, either 'done' (1, as if a run had succeeded) or 'unknown' (0)")
+	flag.StringSlice("jobs.schedule", []string{}, "Expected interval of a job in the form job=duration or job=znapzend plan, e.g. tank/data=1day=>1hour,7days=>1day. Can be specified multiple times")
+	flag.Duration("jobs.scheduleGrace", cfg.Jobs.ScheduleGrace, "Duration a scheduled snapshot or send may finish late before it is counted as missed")
+	flag.Duration("hooks.maxClockSkew", cfg.Hooks.MaxClockSkew, "Maximum duration the Timestamp parameter of a hook may lie in the future")
+	flag.Duration("hooks.maxAge", cfg.Hooks.MaxAge, "Maximum age of the Timestamp parameter of a hook. 0 accepts events of any age")
+	flag.Bool("hooks.validateNames", cfg.Hooks.ValidateNames, "Reject job names that are not valid ZFS dataset names")
+	flag.Bool("hooks.requireRunID", cfg.Hooks.RequireRunID, "Reject post hooks without the RunID returned by the pre hook")
+	flag.Duration("hooks.runTimeout", cfg.Hooks.RunTimeout, "Duration after which a started snapshot or send without post hook is counted as orphaned. 0 keeps them forever")
+	flag.Bool("hooks.allowList", cfg.Hooks.AllowList, "Only accept hooks of jobs registered at startup, reject unknown jobs with 404")
+	flag.Int("limits.maxJobs", cfg.Limits.MaxJobs, "Maximum number of jobs, hooks of further jobs are rejected. 0 disables the limit")
+	flag.Int("limits.maxTargets", cfg.Limits.MaxTargets, "Maximum number of target hosts per job, hooks of further target hosts are rejected. 0 disables the limit")
+	flag.Duration("limits.seriesTTL", cfg.Limits.SeriesTTL, "Duration after which the series of a job or target host that has not been updated are deleted. 0 disables eviction")
+	flag.Float64("ratelimit.clientRate", cfg.RateLimit.ClientRate, "Maximum number of hook calls per second and client address. 0 disables the limit")
+	flag.Int("ratelimit.clientBurst", cfg.RateLimit.ClientBurst, "Number of hook calls a client may exceed the rate with in a burst")
+	flag.Float64("ratelimit.jobRate", cfg.RateLimit.JobRate, "Maximum number of hook calls per second and job. 0 disables the limit")
+	flag.Int("ratelimit.jobBurst", cfg.RateLimit.JobBurst, "Number of hook calls a job may exceed the rate with in a burst")
+	flag.String("metrics.namespace", cfg.Metrics.Namespace, "Namespace (prefix) of all metric names")
+	flag.String("metrics.datasetLabel", cfg.Metrics.DatasetLabel, "Name of the label that holds the dataset (job name)")
+	flag.Bool("metrics.poolLabels", cfg.Metrics.PoolLabels, "Add the 'pool' and 'dataset' labels derived from the dataset path")
+	flag.Bool("metrics.legacyGauges", cfg.Metrics.LegacyGauges, "Expose the presnap, postsnap, presend and postsend gauges besides the job phase")
+	flag.Bool("metrics.parentLabel", cfg.Metrics.ParentLabel, "Add the 'parent' label containing the path of the parent dataset")
+	flag.StringSlice("metrics.constLabels", []string{}, "Constant labels in the form key=value added to all metrics. Can be specified multiple times")
+	flag.StringSlice("metrics.jobLabels", []string{}, "Additional labels of a job in the form job:key=value added to all metrics of the job. Can be specified multiple times")
+	flag.Bool("tenants.enabled", cfg.Tenants.Enabled, "Enable the multi-tenant mode, in which the jobs of several znapzend hosts are separated by source host")
+	flag.String("tenants.label", cfg.Tenants.Label, "Name of the label that holds the source host in multi-tenant mode")
+	flag.StringSlice("tenants.tokens", []string{}, "Bearer tokens of source hosts in the form host=token. Hosts with a token can only be updated with the token. Can be specified multiple times")
+	flag.StringSlice("tenants.addresses", []string{}, "Client addresses of source hosts in the form host=ip or host=cidr. Can be specified multiple times")
+	flag.Bool("tenants.allowUnauthenticated", cfg.Tenants.AllowUnauthenticated, "Accept a SourceHost parameter of hosts that have neither a token nor an address")
+	flag.String("state.backend", cfg.State.Backend, "Backend to share the state between replicas, either 'file' or 'gossip'. Empty disables sharing")
+	flag.String("state.path", cfg.State.Path, "Path of the state file on a volume shared by all replicas (file backend)")
+	flag.StringSlice("state.peers", []string{}, "Base URLs of the other replicas, e.g. http://replica-2:8080 (gossip backend). Can be specified multiple times")
+	flag.String("state.token", cfg.State.Token, "Token shared by all replicas to authenticate state updates, required by the gossip backend")
+	flag.Duration("state.interval", cfg.State.Interval, "Interval in which the state of the other replicas is synced")
+	flag.StringSlice("notify.url", []string{}, "A list of webhook URLs to POST notifications to. Can be specified multiple times")
+	flag.StringSlice("notify.events", cfg.Notify.Events, "A list of events that trigger a notification")
+	flag.Duration("notify.deadline", cfg.Notify.Deadline, "Duration after which a started snapshot or send is considered stuck. 0 disables detection")
+	flag.Int("notify.retries", cfg.Notify.Retries, "Number of retries if a webhook could not be delivered")
+	flag.Duration("notify.backoff", cfg.Notify.Backoff, "Initial delay between retries, doubled with each attempt")
+	flag.Duration("notify.timeout", cfg.Notify.Timeout, "Timeout for a single webhook request")
+	flag.String("notify.template", cfg.Notify.Template, "Go template that renders the JSON payload of a notification")
+	flag.String("audit.path", cfg.Audit.Path, "Path of a JSON lines file to which all changes of the monitoring state are appended. Empty disables the audit log")
+	flag.Int("audit.maxSize", cfg.Audit.MaxSize, "Size in megabytes after which the audit log is rotated. 0 disables rotation")
+	flag.Int("audit.maxBackups", cfg.Audit.MaxBackups, "Number of rotated audit logs to keep")
+	flag.StringSlice("maintenance.window", []string{}, "Recurring maintenance window in local time in the form pattern=days HH:MM-HH:MM, e.g. 'tank/*=Sat-Sun 02:00-06:00'. Can be specified multiple times")
+	flag.String("maintenance.path", cfg.Maintenance.Path, "Path of a JSON file to persist the silences set through the API across restarts. Empty keeps them in memory")
+	flag.String("push.url", cfg.Push.URL, "URL of a Pushgateway or remote write endpoint to periodically push metrics to. Empty disables pushing")
+	flag.String("push.mode", cfg.Push.Mode, "Push protocol, either 'pushgateway' or 'remote_write'")
+	flag.Duration("push.interval", cfg.Push.Interval, "Interval between pushes")
+	flag.String("push.job", cfg.Push.Job, "Value of the 'job' grouping label")
+	flag.StringSlice("push.grouping", []string{}, "Additional grouping labels in the form key=value. Can be specified multiple times")
+	flag.String("push.username", cfg.Push.Username, "Username for basic authentication")
+	flag.String("push.password", cfg.Push.Password, "Password for basic authentication")
+	flag.String("push.bearerToken", cfg.Push.BearerToken, "Bearer token for authentication, takes precedence over basic authentication")
+	flag.Duration("push.timeout", cfg.Push.Timeout, "Timeout for a single push")
 
 	if err := viper.BindPFlags(flag.CommandLine); err != nil {
 		log.Fatal(err)
@@ -84,18 +243,114 @@ func GetConfig() ConfigMap {
 type (
 	// ConfigMap is the root config map
 	ConfigMap struct {
-		Log      LogMap
-		BindAddr string
-		Jobs     JobMap
+		Log            LogMap
+		BindAddr       string
+		TrustedProxies []string
+		Jobs           JobMap
+		Hooks          HooksMap
+		Limits         LimitsMap
+		RateLimit      RateLimitMap
+		Metrics        MetricsMap
+		Tenants        TenantsMap
+		State          StateMap
+		Notify         NotifyMap
+		Audit          AuditMap
+		Maintenance    MaintenanceMap
+		Push           PushMap
 	}
 	// LogMap contains config for logging
 	LogMap struct {
 		Level     string
 		Formatter string
+		Syslog    string
 	}
 	// JobMap contains values for prometheus "jobs"
 	JobMap struct {
-		Register []string
+		Register      []string
+		InitialState  string
+		Schedule      []string
+		ScheduleGrace time.Duration
+	}
+	// HooksMap contains config for the validation of hook calls
+	HooksMap struct {
+		MaxClockSkew  time.Duration
+		MaxAge        time.Duration
+		ValidateNames bool
+		AllowList     bool
+		RequireRunID  bool
+		RunTimeout    time.Duration
+	}
+	// LimitsMap contains config for limiting the number of series
+	LimitsMap struct {
+		MaxJobs    int
+		MaxTargets int
+		SeriesTTL  time.Duration
+	}
+	// RateLimitMap contains config for limiting the rate of hook calls
+	RateLimitMap struct {
+		ClientRate  float64
+		ClientBurst int
+		JobRate     float64
+		JobBurst    int
+	}
+	// MetricsMap contains config for the names and labels of the metrics
+	MetricsMap struct {
+		Namespace    string
+		DatasetLabel string
+		PoolLabels   bool
+		ParentLabel  bool
+		ConstLabels  []string
+		JobLabels    []string
+		LegacyGauges bool
+	}
+	// TenantsMap contains config for the multi-tenant mode
+	TenantsMap struct {
+		Enabled              bool
+		Label                string
+		Tokens               []string
+		Addresses            []string
+		AllowUnauthenticated bool
+	}
+	// StateMap contains config for sharing the state between replicas
+	StateMap struct {
+		Backend  string
+		Path     string
+		Peers    []string
+		Token    string
+		Interval time.Duration
+	}
+	// NotifyMap contains config for webhook notifications
+	NotifyMap struct {
+		URL      []string
+		Events   []string
+		Deadline time.Duration
+		Retries  int
+		Backoff  time.Duration
+		Timeout  time.Duration
+		Template string
+	}
+	// AuditMap contains config for the audit log
+	AuditMap struct {
+		Path       string
+		MaxSize    int
+		MaxBackups int
+	}
+	// MaintenanceMap contains config for silencing jobs during maintenance
+	MaintenanceMap struct {
+		Window []string
+		Path   string
+	}
+	// PushMap contains config for pushing metrics to hosts that cannot scrape the exporter
+	PushMap struct {
+		URL         string
+		Mode        string
+		Interval    time.Duration
+		Job         string
+		Grouping    []string
+		Username    string
+		Password    string
+		BearerToken string
+		Timeout     time.Duration
 	}
 )
 
@@ -116,13 +371,43 @@ func LogrusHandler() gin.HandlerFunc {
 		log.WithFields(filterAndCombineLoggingKeys(log.Fields{
 			"status_code":  c.Writer.Status(),
 			"latency_time": time.Now().Sub(startTime),
-			"client_ip":    c.ClientIP(),
+			"client_ip":    clientAddress(c),
 			"req_method":   c.Request.Method,
 			"req_uri":      c.Request.RequestURI,
 		}, c.Keys)).Log(logLevel, message)
 	}
 }
 
+// InstrumentHandler implements a Gin HandlerFunc that counts the requests and observes their duration by route template.
+func InstrumentHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		startTime := time.Now()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestsMetric.WithLabelValues(route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDurationMetric.WithLabelValues(route).Observe(time.Since(startTime).Seconds())
+	}
+}
+
+// RequestIDHandler implements a Gin HandlerFunc that assigns an ID to each request. An ID given by the client in the
+// X-Request-Id header is reused if it matches the format of a RunID, as it ends up in logs, exemplars and the audit
+// log; otherwise a new ID is generated. The ID is echoed in the response header and logged along with the request.
+func RequestIDHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if id == "" || !runIDPattern.MatchString(id) {
+			id = newRunID()
+		}
+		c.Set(requestIDKey, id)
+		c.Header(requestIDHeader, id)
+	}
+}
+
 // GetOrDefault gets the value of the given map by key. If the value is nil or not found, defaultValue is returned.
 func GetOrDefault(keys map[string]interface{}, key string, defaultValue interface{}) interface{} {
 	var value = keys[key]
@@ -139,6 +424,13 @@ func filterAndCombineLoggingKeys(fields log.Fields, keys map[string]interface{})
 		case "log_level":
 		case "log_skip":
 			break
+		case parameterKey:
+			// Flatten the parameters, so that the log entries can be indexed by job and target host.
+			if job, ok := keys[key].(Job); ok {
+				for name, value := range job.logFields() {
+					fields[name] = value
+				}
+			}
 		default:
 			fields[key] = keys[key]
 		}
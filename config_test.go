@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_newLogFormatter(t *testing.T) {
+	tests := []struct {
+		name      string
+		formatter string
+		expected  log.Formatter
+		wantErr   bool
+	}{
+		{name: "GivenJSON_ThenJSONFormatter", formatter: "json", expected: &log.JSONFormatter{}},
+		{name: "GivenLogfmt_ThenTextFormatterWithoutColors", formatter: "logfmt", expected: &log.TextFormatter{FullTimestamp: true, DisableColors: true}},
+		{name: "GivenText_ThenTextFormatter", formatter: "text", expected: &log.TextFormatter{FullTimestamp: true}},
+		{name: "GivenUnknown_ThenTextFormatterAndError", formatter: "xml", expected: &log.TextFormatter{FullTimestamp: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newLogFormatter(tt.formatter)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func Test_addSyslogHook_InvalidAddress(t *testing.T) {
+	assert.Error(t, addSyslogHook("host:514"))
+}
+
+func Test_filterAndCombineLoggingKeys(t *testing.T) {
+	fields := filterAndCombineLoggingKeys(log.Fields{"status_code": 200}, map[string]interface{}{
+		"log_level":  log.InfoLevel,
+		parameterKey: Job{JobName: "tank/data", TargetHost: "host", requestID: "abc"},
+	})
+	assert.Equal(t, log.Fields{
+		"status_code": 200,
+		"job":         "tank/data",
+		"target_host": "host",
+		requestIDKey:  "abc",
+	}, fields)
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		expected string
+	}{
+		{name: "GivenValidID_ThenReuse", header: "req-1.a_B", expected: "req-1.a_B"},
+		{name: "GivenNoID_ThenGenerate", header: ""},
+		{name: "GivenInvalidCharacters_ThenGenerate", header: "abc\" injected=\"1"},
+		{name: "GivenTooLongID_ThenGenerate", header: strings.Repeat("a", 65)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(RequestIDHandler())
+			var id string
+			r.GET("/", func(c *gin.Context) {
+				id = c.GetString(requestIDKey)
+			})
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(requestIDHeader, tt.header)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if tt.expected != "" {
+				assert.Equal(t, tt.expected, id)
+			} else {
+				assert.Regexp(t, "^[0-9a-f]{16}$", id)
+			}
+			assert.Equal(t, id, w.Header().Get(requestIDHeader))
+		})
+	}
+}
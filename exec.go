@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// exitCodeNotStarted is the exit code reported if the command could not be started, as returned by shells.
+	exitCodeNotStarted = 127
+)
+
+type (
+	// tailBuffer keeps the last bytes written to it.
+	tailBuffer struct {
+		size int
+		data []byte
+	}
+)
+
+// Write appends p, discarding everything but the last size bytes.
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	if len(b.data) > b.size {
+		b.data = b.data[len(b.data)-b.size:]
+	}
+	return len(p), nil
+}
+
+// String returns the kept bytes without surrounding whitespace and invalid UTF-8 at the cut.
+func (b *tailBuffer) String() string {
+	return strings.TrimSpace(strings.ToValidUTF8(string(b.data), ""))
+}
+
+// runExecCommand implements the "exec" subcommand, which wraps a command between the pre and post hooks of a snapshot
+// or send. The exit code and the end of stderr of a failed command are reported with the post hook, and the exit code
+// is returned.
+func runExecCommand(args []string) int {
+	flags := flag.NewFlagSet("exec", flag.ContinueOnError)
+	baseURL := flags.String("url", "http://localhost:8080", "Base URL of the exporter")
+	spoolDir := flags.String("spool.dir", "", "Directory to store events in while the exporter is unreachable. Empty disables spooling")
+	phase := flags.String("phase", "", "Phase of the job the command implements: snapshot or send")
+	job := flags.String("job", "", "Job (pool/dataset) of the command")
+	target := flags.String("target", "", "Target host of the send")
+	params := flags.StringSlice("param", []string{}, "Additional query parameters of both hooks in the form key=value. Can be specified multiple times")
+	timeout := flags.Duration("timeout", 10*time.Second, "Timeout for a single request")
+	stderrTail := flags.Int("stderrTail", 512, "Number of bytes at the end of stderr that are reported if the command fails")
+	flags.SetInterspersed(false)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s exec [flags] -- <command> [args...]\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	var pre, post Phase
+	switch *phase {
+	case "snapshot":
+		pre, post = PhasePreSnap, PhasePostSnap
+	case "send":
+		pre, post = PhasePreSend, PhasePostSend
+	}
+	if pre == "" || *job == "" || flags.NArg() == 0 || (pre == PhasePreSend && *target == "") {
+		flags.Usage()
+		return 2
+	}
+	hookParams := map[string]string{"RunID": newRunID()}
+	for _, pair := range *params {
+		arr := strings.SplitN(pair, "=", 2)
+		if len(arr) != 2 {
+			log.WithField("param", pair).Error("Invalid parameter, expected key=value.")
+			return 2
+		}
+		hookParams[arr[0]] = arr[1]
+	}
+	if *target != "" {
+		hookParams["TargetHost"] = *target
+	}
+
+	client := NewClient(*baseURL, *spoolDir, *timeout)
+	// A failed hook must not prevent the snapshot or send, the command is run regardless.
+	if err := client.Deliver(HookEvent{Phase: pre, Job: *job, Params: hookParams, Timestamp: time.Now()}); err != nil {
+		log.WithError(err).Error("Could not deliver event.")
+	}
+	started := time.Now()
+	exitCode, message := runWrapped(flags.Args(), *stderrTail)
+	logEvent := log.WithFields(log.Fields{"job": *job, "exit_code": exitCode, "duration": time.Since(started)})
+	if exitCode != 0 {
+		hookParams["ExitCode"] = strconv.Itoa(exitCode)
+		hookParams["Error"] = message
+		logEvent.WithField("error", message).Warn("Command has failed.")
+	} else {
+		logEvent.Debug("Command has finished.")
+	}
+	if err := client.Deliver(HookEvent{Phase: post, Job: *job, Params: hookParams, Timestamp: time.Now()}); err != nil {
+		log.WithError(err).Error("Could not deliver event.")
+	}
+	return exitCode
+}
+
+// runWrapped runs the command with the stdin and stdout of the process. Stderr is passed through as well and its last
+// tailSize bytes are kept. SIGINT and SIGTERM are forwarded to the command, which is waited for, so that the post hook
+// reports the interrupted run. Returns the exit code of the command, or 128 plus the signal if it has been terminated
+// or interrupted by a signal, and, if it has failed, the end of stderr or the reason why it could not be started.
+func runWrapped(args []string, tailSize int) (int, string) {
+	tail := &tailBuffer{size: tailSize}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, io.MultiWriter(os.Stderr, tail)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	if err := cmd.Start(); err != nil {
+		return exitCodeNotStarted, err.Error()
+	}
+	done := make(chan struct{})
+	interrupted := make(chan os.Signal, 1)
+	go func() {
+		var received os.Signal
+		for {
+			select {
+			case sig := <-signals:
+				received = sig
+				log.WithField("signal", sig).Info("Forwarding signal to command.")
+				_ = cmd.Process.Signal(sig)
+			case <-done:
+				interrupted <- received
+				return
+			}
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	received := <-interrupted
+
+	exitCode := 0
+	if exitErr, exited := err.(*exec.ExitError); exited {
+		exitCode = exitErr.ExitCode()
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			exitCode = 128 + int(status.Signal())
+		}
+	} else if err != nil {
+		return 1, err.Error()
+	}
+	if exitCode == 0 && received != nil {
+		// The command has handled the signal, but the run has not finished as planned.
+		exitCode = 128 + int(received.(syscall.Signal))
+		err = fmt.Errorf("interrupted by %v", received)
+	}
+	if exitCode == 0 {
+		return 0, ""
+	}
+	if message := tail.String(); message != "" {
+		return exitCode, message
+	}
+	return exitCode, err.Error()
+}
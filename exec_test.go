@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func Test_runExecCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		exitCode int
+		phases   []string
+		error    string
+	}{
+		{name: "Success", args: []string{"--phase", "snapshot", "--job", "tank/data", "--", "true"},
+			phases: []string{"/presnap/tank/data", "/postsnap/tank/data"}},
+		{name: "Failure", args: []string{"--phase", "send", "--job", "tank/data", "--target", "remote", "--",
+			"sh", "-c", "echo first >&2; echo cannot receive >&2; exit 3"},
+			exitCode: 3, phases: []string{"/presend/tank/data", "/postsend/tank/data"}, error: "first\ncannot receive"},
+		{name: "TruncatedStderr", args: []string{"--phase", "snapshot", "--job", "tank/data", "--stderrTail", "15", "--",
+			"sh", "-c", "echo first >&2; echo cannot receive >&2; exit 1"},
+			exitCode: 1, phases: []string{"/presnap/tank/data", "/postsnap/tank/data"}, error: "cannot receive"},
+		{name: "NotStarted", args: []string{"--phase", "snapshot", "--job", "tank/data", "--", "/nonexistent/command"},
+			exitCode: exitCodeNotStarted, phases: []string{"/presnap/tank/data", "/postsnap/tank/data"}, error: "/nonexistent/command"},
+		{name: "TerminatedBySignal", args: []string{"--phase", "snapshot", "--job", "tank/data", "--",
+			"sh", "-c", "echo stopping >&2; kill -TERM $PPID; exec sleep 5"},
+			exitCode: 128 + int(syscall.SIGTERM), phases: []string{"/presnap/tank/data", "/postsnap/tank/data"}, error: "stopping"},
+		{name: "SignalHandledByCommand", args: []string{"--phase", "snapshot", "--job", "tank/data", "--",
+			"sh", "-c", "trap 'exit 0' TERM; kill -TERM $PPID; while :; do sleep 0.1; done"},
+			exitCode: 128 + int(syscall.SIGTERM), phases: []string{"/presnap/tank/data", "/postsnap/tank/data"}, error: "interrupted"},
+		{name: "MissingTarget", args: []string{"--phase", "send", "--job", "tank/data", "--", "true"}, exitCode: 2},
+		{name: "UnknownPhase", args: []string{"--phase", "presnap", "--job", "tank/data", "--", "true"}, exitCode: 2},
+		{name: "MissingCommand", args: []string{"--phase", "snapshot", "--job", "tank/data"}, exitCode: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received []*http.Request
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = append(received, r)
+			}))
+			defer server.Close()
+
+			assert.Equal(t, tt.exitCode, runExecCommand(append([]string{"--url", server.URL}, tt.args...)))
+			var phases []string
+			for _, r := range received {
+				phases = append(phases, r.URL.Path)
+			}
+			assert.Equal(t, tt.phases, phases)
+			if len(received) != 2 {
+				return
+			}
+			pre, post := received[0].URL.Query(), received[1].URL.Query()
+			assert.NotEmpty(t, pre.Get("RunID"))
+			assert.Equal(t, pre.Get("RunID"), post.Get("RunID"))
+			if tt.exitCode == 0 {
+				assert.Empty(t, post.Get("ExitCode"))
+				return
+			}
+			assert.Equal(t, strconv.Itoa(tt.exitCode), post.Get("ExitCode"))
+			assert.Contains(t, post.Get("Error"), tt.error)
+		})
+	}
+}
+
+func Test_tailBuffer(t *testing.T) {
+	tail := &tailBuffer{size: 5}
+	_, _ = tail.Write([]byte("abc"))
+	_, _ = tail.Write([]byte("defg\n"))
+	assert.Equal(t, "defg", tail.String())
+
+	tail = &tailBuffer{size: 3}
+	_, _ = tail.Write([]byte(strings.Repeat("ä", 3)))
+	assert.Equal(t, "ä", tail.String(), "a character cut at the beginning is dropped")
+}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"math"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type (
@@ -20,76 +30,340 @@ type (
 		ResetPostSend  bool          `binding:"-"`
 		SelfResetAfter time.Duration `binding:"-"`
 		TargetHost     string        `binding:"-"`
+		Snapshot       string        `binding:"-"`
+		SourceHost     string        `binding:"-"`
+		Timestamp      string        `binding:"-"`
+		Recursive      bool          `binding:"-"`
+		RunID          string        `binding:"-"`
+		Bytes          uint64        `binding:"-"`
+		Total          uint64        `binding:"-"`
+		ExitCode       int           `binding:"-"`
+		Error          string        `binding:"-"`
+		requestID      string
+		eventTime      time.Time
+	}
+	// Phase identifies which hook of a znapzend run has been called
+	Phase string
+	// jobNameError is returned if the job name is not a valid dataset name.
+	jobNameError struct {
+		error
+	}
+	// unknownJobError is returned if a job that is not registered is registered through the API in allow-list mode.
+	unknownJobError struct {
+		error
 	}
 )
 
 var (
-	promHandler = promhttp.Handler()
+	runIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{0,64}$`)
+	// hooksConfig contains the limits that are applied to the parameters of the hooks.
+	hooksConfig = CreateDefaultConfig().Hooks
+	promHandler = promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+			EnableOpenMetrics:                   true,
+			EnableOpenMetricsTextCreatedSamples: true,
+		}),
+	)
+
+	// trustedProxies contains the networks of the reverse proxies whose X-Forwarded-For header is trusted.
+	trustedProxies []*net.IPNet
 )
 
 const (
 	parameterKey = "parameters"
+
+	// maxJobNameLength is the maximum length of a ZFS dataset name.
+	maxJobNameLength = 255
+	// maxErrorLength is the maximum length of the Error parameter, longer errors are truncated at the beginning.
+	maxErrorLength = 1024
+
+	// RejectReasonInvalidName is the reason of a rejected hook call whose job name is not a valid dataset name.
+	RejectReasonInvalidName = "invalid_name"
+	// RejectReasonInvalidParameters is the reason of a rejected hook call with invalid query parameters.
+	RejectReasonInvalidParameters = "invalid_parameters"
+	// RejectReasonUnknownJob is the reason of a rejected hook call for an unregistered job in allow-list mode.
+	RejectReasonUnknownJob = "unknown_job"
+	// RejectReasonTenant is the reason of a rejected hook call whose source host could not be resolved or authenticated.
+	RejectReasonTenant = "tenant"
+	// RejectReasonSeriesLimit is the reason of a rejected hook call that would exceed the cardinality limits.
+	RejectReasonSeriesLimit = "series_limit"
+
+	// PhasePreSnap is the phase of a job whose snapshot has been started.
+	PhasePreSnap Phase = "presnap"
+	// PhasePostSnap is the phase of a job whose snapshot has finished.
+	PhasePostSnap Phase = "postsnap"
+	// PhasePreSend is the phase of a job whose send to a target host has been started.
+	PhasePreSend Phase = "presend"
+	// PhasePostSend is the phase of a job whose send to a target host has finished.
+	PhasePostSend Phase = "postsend"
+
+	// gaugeSnapshotState and gaugeSendState identify the state gauges in the shared state.
+	gaugeSnapshotState Phase = "snapshot_state"
+	gaugeSendState     Phase = "send_state"
+	gaugeJobPhase      Phase = "job_phase"
+	gaugeSilenced      Phase = "silenced"
+	// gaugeLastSnapshot and gaugeLastSend identify the times of the last successful snapshot and send in the shared state.
+	gaugeLastSnapshot Phase = "last_snapshot"
+	gaugeLastSend     Phase = "last_send"
+
+	// PhaseUnknown is the phase of a registered job before the first hook.
+	PhaseUnknown Phase = "unknown"
+	// PhaseFailed is the phase of a job whose post hook reported a non-zero exit code.
+	PhaseFailed Phase = "failed"
+
+	// JobStateUnknown is the state of a registered job that has not run since the exporter started.
+	JobStateUnknown = 0
+	// JobStateInProgress is the state of a job whose snapshot or send has been started.
+	JobStateInProgress = 1
+	// JobStateDone is the state of a job whose snapshot or send has succeeded.
+	JobStateDone = 2
+	// JobStateFailed is the state of a job whose snapshot or send reported a non-zero exit code.
+	JobStateFailed = 3
+
+	// InitialStateUnknown initializes the gauges of registered jobs with 0.
+	InitialStateUnknown = "unknown"
+	// InitialStateDone initializes the gauges of registered jobs with 1, as if a run had succeeded.
+	InitialStateDone = "done"
 )
 
 func handlePreSnap(context *gin.Context) {
-	job := context.MustGet(parameterKey).(Job)
-	job.setMetric(preSnapMetric)
-	job.ResetMetrics(
-		ResetMetricTuple{job.ResetPostSnap, "", postSnapMetric},
-		ResetMetricTuple{job.ResetPreSend, "", preSendMetric},
-	)
+	applyHook(context, PhasePreSnap, func(job Job) {
+		job.setMetric(preSnapMetric)
+		onTransition(job, PhasePreSnap)
+		job.ResetMetrics(
+			ResetMetricTuple{job.ResetPostSnap, "", postSnapMetric},
+			ResetMetricTuple{job.ResetPreSend, job.TargetHost, preSendMetric},
+		)
+	})
 }
 
 func handlePostSnap(context *gin.Context) {
-	job := context.MustGet(parameterKey).(Job)
-	job.setMetric(postSnapMetric)
-	job.ResetMetrics(
-		ResetMetricTuple{job.ResetPreSnap, "", preSnapMetric},
-		ResetMetricTuple{job.ResetPreSend, "", preSendMetric},
-	)
+	applyHook(context, PhasePostSnap, func(job Job) {
+		if job.ExitCode != 0 {
+			onFailure(job, PhasePostSnap)
+			return
+		}
+		job.setMetric(postSnapMetric)
+		onTransition(job, PhasePostSnap)
+		job.ResetMetrics(
+			ResetMetricTuple{job.ResetPreSnap, "", preSnapMetric},
+			ResetMetricTuple{job.ResetPreSend, job.TargetHost, preSendMetric},
+		)
+	})
 }
 
 func handlePreSend(context *gin.Context) {
-	job := context.MustGet(parameterKey).(Job)
-	job.setMetricWithHost(preSendMetric)
-	job.ResetMetrics(
-		ResetMetricTuple{job.ResetPreSnap, "", preSnapMetric},
-		ResetMetricTuple{job.ResetPostSnap, "", postSnapMetric},
-		ResetMetricTuple{job.ResetPostSend, job.TargetHost, postSendMetric},
-	)
+	applyHook(context, PhasePreSend, func(job Job) {
+		job.setMetricWithHost(preSendMetric)
+		onTransition(job, PhasePreSend)
+		job.ResetMetrics(
+			ResetMetricTuple{job.ResetPreSnap, "", preSnapMetric},
+			ResetMetricTuple{job.ResetPostSnap, "", postSnapMetric},
+			ResetMetricTuple{job.ResetPostSend, job.TargetHost, postSendMetric},
+		)
+	})
 }
 
 func handlePostSend(context *gin.Context) {
-	job := context.MustGet(parameterKey).(Job)
-	job.setMetricWithHost(postSendMetric)
-	job.ResetMetrics(
-		ResetMetricTuple{job.ResetPreSnap, "", preSnapMetric},
-		ResetMetricTuple{job.ResetPostSnap, "", postSnapMetric},
-		ResetMetricTuple{job.ResetPreSend, job.TargetHost, preSendMetric},
-	)
+	applyHook(context, PhasePostSend, func(job Job) {
+		if job.ExitCode != 0 {
+			onFailure(job, PhasePostSend)
+			return
+		}
+		job.setMetricWithHost(postSendMetric)
+		onTransition(job, PhasePostSend)
+		job.ResetMetrics(
+			ResetMetricTuple{job.ResetPreSnap, "", preSnapMetric},
+			ResetMetricTuple{job.ResetPostSnap, "", postSnapMetric},
+			ResetMetricTuple{job.ResetPreSend, job.TargetHost, preSendMetric},
+		)
+	})
 }
 
-func handleRegister(context *gin.Context) {
+// applyHook applies the hook to the job of the request and, if Recursive is set, to all known children of the dataset.
+// Events that are older than the last event of the same job, e.g. replayed from a spool, are acknowledged but
+// otherwise ignored, as they would overwrite a newer state. All jobs are updated while holding hookMutex, so that a
+// scrape never sees a partially applied recursive hook.
+func applyHook(context *gin.Context, phase Phase, apply func(job Job)) {
 	job := context.MustGet(parameterKey).(Job)
-	if err := job.RegisterMetric(); err != nil {
-		SetLogWithFields(context, log.WarnLevel, "Could not register metric.", log.Fields{
-			"error": err,
+	if _, finished := startedPhase(phase); !finished && job.RunID == "" {
+		job.RunID = newRunID()
+	}
+	if hooksConfig.AllowList && !isKnownDataset(job) {
+		countRejectedHook(context, RejectReasonUnknownJob)
+		SetLogWithFields(context, log.WarnLevel, "Rejected hook of unknown job.", log.Fields{})
+		context.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("job is not registered: %s", job.JobName),
 		})
-		context.JSON(http.StatusBadRequest, gin.H{
-			"status": "failed",
+		return
+	}
+	jobs := []Job{job}
+	if job.Recursive {
+		jobs = append(jobs, job.children()...)
+	}
+	applied, ignored, rejected := []string{}, []string{}, []string{}
+	var latest time.Time
+	var limitErr error
+	func() {
+		hookMutex.Lock()
+		// Unlocked by defer, as gin.Recovery would otherwise leave the mutex locked after a panic.
+		defer hookMutex.Unlock()
+		for _, j := range jobs {
+			before := j.auditGauges()
+			if err := rememberDataset(j); err != nil {
+				limitErr = err
+				rejected = append(rejected, j.JobName)
+				audit.Record(context, j, AuditResultRejected, before, before)
+				continue
+			}
+			var accepted bool
+			if latest, accepted = j.acceptEvent(phase); !accepted {
+				ignored = append(ignored, j.JobName)
+				audit.Record(context, j, AuditResultIgnored, before, before)
+				continue
+			}
+			apply(j)
+			applied = append(applied, j.JobName)
+			result := AuditResultApplied
+			if _, finished := startedPhase(phase); finished && j.ExitCode != 0 {
+				result = AuditResultFailed
+			}
+			audit.Record(context, j, result, before, j.auditGauges())
+		}
+	}()
+
+	if len(rejected) > 0 {
+		countRejectedHook(context, RejectReasonSeriesLimit)
+	}
+	if job.Recursive {
+		SetLogWithFields(context, log.InfoLevel, "", log.Fields{
+			"applied": len(applied), "ignored": len(ignored), "rejected": len(rejected),
+		})
+		response := gin.H{"status": "applied", "jobs": applied, "ignored": ignored, "rejected": rejected}
+		context.JSON(http.StatusOK, withRunID(context, response, job.RunID))
+		return
+	}
+	if limitErr != nil {
+		SetLogWithFields(context, log.WarnLevel, "Rejected hook due to series limit.", log.Fields{"error": limitErr})
+		context.JSON(http.StatusUnprocessableEntity, gin.H{"error": limitErr.Error()})
+		return
+	}
+	if len(ignored) > 0 {
+		SetLogWithFields(context, log.WarnLevel, "Ignored outdated event.", log.Fields{"latest_event": latest})
+		context.JSON(http.StatusOK, gin.H{
+			"status": "ignored",
 			"job":    job.JobName,
-			"error":  err.Error(),
+			"reason": fmt.Sprintf("a newer event from %s has already been applied", latest.Format(time.RFC3339Nano)),
 		})
+		return
+	}
+	response := gin.H{"status": "applied", "job": job.JobName}
+	context.JSON(http.StatusOK, withRunID(context, response, job.RunID))
+}
+
+// withRunID adds the run ID to the response and to the log entry of the request, unless it is empty.
+func withRunID(context *gin.Context, response gin.H, runID string) gin.H {
+	if runID != "" {
+		response["run_id"] = runID
+		context.Set("run_id", runID)
+	}
+	return response
+}
+
+// newRunID returns a random ID for a run that has been started without a RunID.
+func newRunID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// onFailure is called by the post hook handlers instead of setting the gauges if the command of the run has failed.
+// The gauges of the pre and post commands keep their values.
+func onFailure(job Job, phase Phase) {
+	started, _ := startedPhase(phase)
+	job.SetFailed(started)
+	job.FailRun(phase)
+	if phase == PhasePostSend {
+		job.resetProgress()
+	}
+	notifier.Fail(job, phase)
+}
+
+// onTransition is called by the hook handlers after the job has entered the given phase.
+func onTransition(job Job, phase Phase) {
+	job.SetState(phase)
+	job.SetPhase(phase)
+	job.ObserveRun(phase)
+	job.ObserveSchedule(phase)
+	if phase == PhasePreSend || phase == PhasePostSend {
+		job.resetProgress()
+	}
+	notifier.Observe(job, phase)
+}
+
+func handleRegister(context *gin.Context) {
+	job := context.MustGet(parameterKey).(Job)
+	if err := registerJob(context, job); err != nil {
+		respondRegisterError(context, job, err)
+		return
 	}
 	context.JSON(http.StatusOK, gin.H{"status": "registered", "job": job.JobName})
 }
 
 func handleUnregister(context *gin.Context) {
 	job := context.MustGet(parameterKey).(Job)
-	job.UnregisterMetric()
+	unregisterJob(context, job)
 	context.JSON(http.StatusOK, gin.H{"status": "unregistered", "job": job.JobName})
 }
 
+// registerJob registers the job and records the change in the audit log. In allow-list mode, only target hosts of jobs
+// that are already known can be registered, as the API would otherwise bypass the allow-list.
+func registerJob(context *gin.Context, job Job) error {
+	hookMutex.Lock()
+	defer hookMutex.Unlock()
+	before := job.auditGauges()
+	if hooksConfig.AllowList && !isKnownDataset(job) {
+		audit.Record(context, job, AuditResultRejected, before, before)
+		return unknownJobError{fmt.Errorf("job is not registered: %s", job.JobName)}
+	}
+	if err := job.RegisterMetric(); err != nil {
+		audit.Record(context, job, AuditResultFailed, before, before)
+		return err
+	}
+	audit.Record(context, job, AuditResultRegistered, before, job.auditGauges())
+	return nil
+}
+
+// unregisterJob unregisters the job and records the change in the audit log.
+func unregisterJob(context *gin.Context, job Job) {
+	hookMutex.Lock()
+	defer hookMutex.Unlock()
+	before := job.auditGauges()
+	job.UnregisterMetric()
+	audit.Record(context, job, AuditResultUnregistered, before, job.auditGauges())
+}
+
+// respondRegisterError responds with 422 if a limit has been reached, 404 if the job is not in the allow-list, or 400
+// otherwise.
+func respondRegisterError(context *gin.Context, job Job, err error) {
+	SetLogWithFields(context, log.WarnLevel, "Could not register metric.", log.Fields{
+		"error": err,
+	})
+	status := http.StatusBadRequest
+	switch err.(type) {
+	case seriesLimitError:
+		status = http.StatusUnprocessableEntity
+	case unknownJobError:
+		status = http.StatusNotFound
+	}
+	context.JSON(status, gin.H{
+		"status": "failed",
+		"job":    job.JobName,
+		"error":  err.Error(),
+	})
+}
+
 func handleMetrics(context *gin.Context) {
 	SetLog(context, log.DebugLevel, "Accessing metrics.")
 	promHandler.ServeHTTP(context.Writer, context.Request)
@@ -122,20 +396,205 @@ func ParseAndValidateInput(c *gin.Context) (Job, error) {
 	if p.JobName = strings.TrimPrefix(c.Param("job"), "/"); p.JobName == "" {
 		return p, errors.New("missing Job name in URL")
 	}
+	name, err := normalizeJobName(p.JobName)
+	if err != nil {
+		return p, err
+	}
+	p.JobName = name
 	if err := c.ShouldBindQuery(&p); err != nil {
 		return p, err
 	}
-	if strings.HasPrefix(c.Request.URL.Path, "/postsend") || strings.HasPrefix(c.Request.URL.Path, "/presend") {
+	// Label values have to be valid UTF-8, otherwise the metrics cannot be updated.
+	for _, param := range [][2]string{{"Job name", p.JobName}, {"TargetHost", p.TargetHost},
+		{"SourceHost", p.SourceHost}, {"RunID", p.RunID}, {"Snapshot", p.Snapshot}} {
+		if !utf8.ValidString(param[1]) {
+			return p, fmt.Errorf("%s is not valid UTF-8", param[0])
+		}
+	}
+	p.requestID = c.GetString(requestIDKey)
+	if p.Timestamp != "" {
+		t, err := parseTimestamp(p.Timestamp)
+		if err != nil {
+			return p, err
+		}
+		if err := validateTimestamp(t, time.Now()); err != nil {
+			return p, err
+		}
+		p.eventTime = t
+	}
+	if len(p.Error) > maxErrorLength {
+		p.Error = p.Error[len(p.Error)-maxErrorLength:]
+	}
+	p.Error = strings.ToValidUTF8(p.Error, "")
+	if !runIDPattern.MatchString(p.RunID) {
+		return p, fmt.Errorf("invalid RunID, expected up to 64 alphanumeric characters or '_-.': %s", p.RunID)
+	}
+	if hooksConfig.RequireRunID && p.RunID == "" &&
+		(strings.HasPrefix(c.Request.URL.Path, "/postsnap") || strings.HasPrefix(c.Request.URL.Path, "/postsend")) {
+		return p, errors.New("missing RunID parameter in query")
+	}
+	if strings.HasPrefix(c.Request.URL.Path, "/postsend") || strings.HasPrefix(c.Request.URL.Path, "/presend") ||
+		strings.HasPrefix(c.Request.URL.Path, "/progress") {
 		if p.TargetHost == "" {
 			return p, errors.New("missing TargetHost parameter in query")
 		}
 	}
-	log.WithFields(log.Fields{
-		"parameters": p,
-	}).Debug("Validated Input Data.")
+	p.logger().Debug("Validated Input Data.")
 	return p, nil
 }
 
+// parseTimestamp parses a timestamp given in RFC3339 or as seconds since the Unix epoch (with optional fractions).
+func parseTimestamp(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		sec, frac := math.Modf(seconds)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return t, fmt.Errorf("invalid Timestamp, expected RFC3339 or Unix time: %s", value)
+	}
+	return t, nil
+}
+
+// normalizeJobName removes duplicate, leading and trailing slashes from the given job name. Unless disabled, the name is
+// validated against the naming rules of ZFS datasets: The pool name starts with a letter, and all components consist
+// of alphanumeric characters and "_-:. " only.
+func normalizeJobName(name string) (string, error) {
+	var components []string
+	for _, component := range strings.Split(name, "/") {
+		if component != "" {
+			components = append(components, component)
+		}
+	}
+	if len(components) == 0 {
+		return "", jobNameError{errors.New("missing Job name in URL")}
+	}
+	normalized := strings.Join(components, "/")
+	if !hooksConfig.ValidateNames {
+		return normalized, nil
+	}
+	if len(normalized) > maxJobNameLength {
+		return "", jobNameError{fmt.Errorf("Job name exceeds %d characters", maxJobNameLength)}
+	}
+	pool := components[0]
+	if first := rune(pool[0]); first > unicode.MaxASCII || !unicode.IsLetter(first) {
+		return "", jobNameError{fmt.Errorf("pool name must start with a letter: %s", pool)}
+	}
+	for _, reserved := range []string{"mirror", "raidz", "draid", "spare"} {
+		if strings.HasPrefix(pool, reserved) {
+			return "", jobNameError{fmt.Errorf("pool name must not start with reserved word %q: %s", reserved, pool)}
+		}
+	}
+	if pool == "log" {
+		return "", jobNameError{fmt.Errorf("pool name is reserved: %s", pool)}
+	}
+	for _, component := range components {
+		if component == "." || component == ".." {
+			return "", jobNameError{fmt.Errorf("invalid dataset name component %q in Job name: %s", component, normalized)}
+		}
+		for _, r := range component {
+			if !validDatasetRune(r) {
+				return "", jobNameError{fmt.Errorf("invalid character %q in Job name: %s", r, normalized)}
+			}
+		}
+	}
+	return normalized, nil
+}
+
+func validDatasetRune(r rune) bool {
+	if r > unicode.MaxASCII {
+		return false
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_-:. ", r)
+}
+
+// clientAddress returns the IP address of the client. The X-Forwarded-For header is only considered if the request has
+// been received from a trusted proxy, in which case the last address that is not a trusted proxy is returned.
+func clientAddress(c *gin.Context) string {
+	address, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		address = c.Request.RemoteAddr
+	}
+	if !isTrustedProxy(address) {
+		return address
+	}
+	forwarded := strings.Split(c.GetHeader("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		address = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return address
+}
+
+// isTrustedProxy returns true if the address belongs to one of the trusted proxies.
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// countRejectedHook increases the counter of rejected hook calls, unless the request is not a hook, e.g. a registration.
+func countRejectedHook(c *gin.Context, reason string) {
+	phase := Phase(strings.SplitN(strings.TrimPrefix(c.Request.URL.Path, "/"), "/", 2)[0])
+	if validPhase(phase) {
+		hookRejectionsMetric.WithLabelValues(string(phase), reason).Inc()
+	}
+}
+
+// validateTimestamp verifies that the given event time lies within the configured limits relative to now.
+func validateTimestamp(t, now time.Time) error {
+	if hooksConfig.MaxClockSkew >= 0 && t.After(now.Add(hooksConfig.MaxClockSkew)) {
+		return fmt.Errorf("Timestamp lies more than %s in the future, check the clock of the source host", hooksConfig.MaxClockSkew)
+	}
+	if hooksConfig.MaxAge > 0 && t.Before(now.Add(-hooksConfig.MaxAge)) {
+		return fmt.Errorf("Timestamp is older than %s", hooksConfig.MaxAge)
+	}
+	return nil
+}
+
+// logFields returns the fields that identify the job in log entries. Empty values are omitted.
+func (p *Job) logFields() log.Fields {
+	fields := log.Fields{"job": p.JobName}
+	for name, value := range map[string]string{
+		"target_host": p.TargetHost,
+		"source_host": p.SourceHost,
+		"snapshot":    p.Snapshot,
+		"run_id":      p.RunID,
+		requestIDKey:  p.requestID,
+	} {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+// logger returns a log entry with the fields of the job.
+func (p *Job) logger() *log.Entry {
+	return log.WithFields(p.logFields())
+}
+
+// at returns the time at which the event of the job occurred: The given Timestamp or the time of the request.
+func (p *Job) at() time.Time {
+	if p.eventTime.IsZero() {
+		return time.Now()
+	}
+	return p.eventTime
+}
+
 // InputValidationHandle returns a Gin handler that parses the input of the request and puts the parsed content into
 // the Gin context keys for later retrieval.
 func InputValidationHandle(paths ...string) gin.HandlerFunc {
@@ -151,6 +610,11 @@ func InputValidationHandle(paths ...string) gin.HandlerFunc {
 		}
 		parameters, err := ParseAndValidateInput(c)
 		if err != nil {
+			if _, invalidName := err.(jobNameError); invalidName {
+				countRejectedHook(c, RejectReasonInvalidName)
+			} else {
+				countRejectedHook(c, RejectReasonInvalidParameters)
+			}
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 				"error": err.Error(),
 			})
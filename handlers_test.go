@@ -5,7 +5,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -41,6 +45,18 @@ func TestParseAndValidateInput(t *testing.T) {
 			},
 			want: Job{JobName: "tank/backup"}.Initialize(),
 		},
+		{
+			name: "GivenQuery_WhenJobWithDuplicateSlashes_ThenNormalizeName",
+			args: args{
+				context: &gin.Context{
+					Params: []gin.Param{
+						{Key: "job", Value: "/tank//backup/"},
+					},
+				},
+				query: "/tank//backup/",
+			},
+			want: Job{JobName: "tank/backup"}.Initialize(),
+		},
 		{
 			name: "GivenQuery_WhenInvalidQuery_ThenThrowError",
 			args: args{
@@ -122,6 +138,74 @@ func TestParseAndValidateInput(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "GivenQueryWithTimestamp_WhenUnixTime_ThenParseTimestamp",
+			args: args{
+				context: &gin.Context{
+					Params: []gin.Param{
+						{Key: "job", Value: "/tank"},
+					},
+				},
+				query: "/tank?Timestamp=1609459200.5",
+			},
+			want: Job{
+				JobName:   "tank",
+				Timestamp: "1609459200.5",
+				eventTime: time.Unix(1609459200, 5e8),
+			}.Initialize(),
+		},
+		{
+			name: "GivenQueryWithError_WhenTooLong_ThenKeepTail",
+			args: args{
+				context: &gin.Context{
+					Params: []gin.Param{
+						{Key: "job", Value: "/tank"},
+					},
+				},
+				query: "/tank?ExitCode=1&Error=" + strings.Repeat("a", 10) + strings.Repeat("b", maxErrorLength),
+			},
+			want: Job{
+				JobName:  "tank",
+				ExitCode: 1,
+				Error:    strings.Repeat("b", maxErrorLength),
+			}.Initialize(),
+		},
+		{
+			name: "GivenPreSendQuery_WhenTargetHostIsInvalidUTF8_ThenThrowError",
+			args: args{
+				context: &gin.Context{
+					Params: []gin.Param{
+						{Key: "job", Value: "/tank"},
+					},
+				},
+				query: "/presend/tank?TargetHost=%ff",
+			},
+			wantErr: true,
+		},
+		{
+			name: "GivenQuery_WhenSourceHostIsInvalidUTF8_ThenThrowError",
+			args: args{
+				context: &gin.Context{
+					Params: []gin.Param{
+						{Key: "job", Value: "/tank"},
+					},
+				},
+				query: "/tank?SourceHost=a%c3",
+			},
+			wantErr: true,
+		},
+		{
+			name: "GivenQueryWithTimestamp_WhenTooFarInFuture_ThenThrowError",
+			args: args{
+				context: &gin.Context{
+					Params: []gin.Param{
+						{Key: "job", Value: "/tank"},
+					},
+				},
+				query: "/tank?Timestamp=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -237,3 +321,284 @@ func Test_handleCommands(t *testing.T) {
 		})
 	}
 }
+
+func Test_handleCommands_Timestamp(t *testing.T) {
+	defer func() {
+		for _, vec := range metricVector {
+			vec.DeleteLabelValues("replayed")
+		}
+	}()
+	r := SetupRouter()
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", query, nil))
+		return w
+	}
+	now := time.Now()
+	unix := func(t time.Time) string {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+
+	// The reset deadline is relative to the timestamp, so a late event with an expired deadline is reset right away.
+	get("/presnap/replayed?SelfResetAfter=1m&Timestamp=" + unix(now.Add(-2*time.Minute)))
+	assert.EqualValues(t, 0, testutil.ToFloat64(preSnapMetric.WithLabelValues("replayed")))
+
+	w := get("/postsnap/replayed?Timestamp=" + unix(now))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.EqualValues(t, 1, testutil.ToFloat64(postSnapMetric.WithLabelValues("replayed")))
+
+	w = get("/presnap/replayed?Timestamp=" + unix(now.Add(-time.Minute)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"ignored"`)
+	assert.EqualValues(t, 1, testutil.ToFloat64(postSnapMetric.WithLabelValues("replayed")), "outdated event must not reset newer state")
+
+	hooksConfig.MaxAge = time.Hour
+	defer func() {
+		hooksConfig = CreateDefaultConfig().Hooks
+	}()
+	w = get("/presnap/replayed?Timestamp=" + unix(now.Add(-2*time.Hour)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func Test_handleCommands_TimestampPerTarget(t *testing.T) {
+	job := Job{JobName: "replayed-send"}
+	defer job.UnregisterMetric()
+	r := SetupRouter()
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", query, nil))
+		return w
+	}
+	now := time.Now()
+	unix := func(t time.Time) string {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+
+	get("/presend/replayed-send?TargetHost=a&Timestamp=" + unix(now.Add(-2*time.Minute)))
+	get("/presend/replayed-send?TargetHost=b&Timestamp=" + unix(now))
+
+	// The late postsend of target a is not outdated by the newer presend of target b.
+	w := get("/postsend/replayed-send?TargetHost=a&Timestamp=" + unix(now.Add(-time.Minute)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"applied"`)
+	assert.EqualValues(t, 1, testutil.ToFloat64(postSendMetric.WithLabelValues("replayed-send", "a")))
+
+	w = get("/presend/replayed-send?TargetHost=a&Timestamp=" + unix(now.Add(-2*time.Minute)))
+	assert.Contains(t, w.Body.String(), `"status":"ignored"`)
+
+	// Unregistering the target host forgets its latest event.
+	target := Job{JobName: "replayed-send", TargetHost: "a"}
+	target.UnregisterMetric()
+	w = get("/presend/replayed-send?TargetHost=a&Timestamp=" + unix(now.Add(-2*time.Minute)))
+	assert.Contains(t, w.Body.String(), `"status":"applied"`)
+}
+
+func Test_handleCommands_Recursive(t *testing.T) {
+	names := []string{"rec", "rec/a", "rec/a/b", "recx"}
+	defer func() {
+		for _, name := range names {
+			job := Job{JobName: name}
+			job.UnregisterMetric()
+		}
+	}()
+	r := SetupRouter()
+	for _, name := range names[1:] {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/register/"+name, nil))
+	}
+
+	postSnapMetric.WithLabelValues("recx").Set(0)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/postsnap/rec?Recursive=true", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"applied","jobs":["rec","rec/a","rec/a/b"],"ignored":[],"rejected":[]}`, w.Body.String())
+	for _, name := range names[:3] {
+		assert.EqualValues(t, 1, testutil.ToFloat64(postSnapMetric.WithLabelValues(name)), name)
+	}
+	assert.EqualValues(t, 0, testutil.ToFloat64(postSnapMetric.WithLabelValues("recx")))
+}
+
+func Test_normalizeJobName(t *testing.T) {
+	tests := []struct {
+		name     string
+		job      string
+		expected string
+		wantErr  bool
+	}{
+		{name: "GivenValidName_ThenKeepName", job: "tank/data-1/home_dir:x.y z", expected: "tank/data-1/home_dir:x.y z"},
+		{name: "GivenSlashes_ThenRemoveEmptyComponents", job: "/tank//data/", expected: "tank/data"},
+		{name: "GivenOnlySlashes_ThenThrowError", job: "//", wantErr: true},
+		{name: "GivenPoolStartingWithDigit_ThenThrowError", job: "1tank/data", wantErr: true},
+		{name: "GivenReservedPoolName_ThenThrowError", job: "mirror-0/data", wantErr: true},
+		{name: "GivenSnapshotName_ThenThrowError", job: "tank/data@snap", wantErr: true},
+		{name: "GivenRelativeComponent_ThenThrowError", job: "tank/../data", wantErr: true},
+		{name: "GivenNonASCIIName_ThenThrowError", job: "tank/dätä", wantErr: true},
+		{name: "GivenTooLongName_ThenThrowError", job: "tank/" + strings.Repeat("a", 251), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeJobName(tt.job)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func Test_handleCommands_AllowList(t *testing.T) {
+	hooksConfig.AllowList = true
+	defer func() {
+		hooksConfig = CreateDefaultConfig().Hooks
+		job := Job{JobName: "allowed"}
+		job.UnregisterMetric()
+	}()
+	r := SetupRouter()
+	get := func(query string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", query, nil))
+		return w.Code
+	}
+	rejected := func(reason string) float64 {
+		return testutil.ToFloat64(hookRejectionsMetric.WithLabelValues(string(PhasePreSnap), reason))
+	}
+	unknown, invalid := rejected(RejectReasonUnknownJob), rejected(RejectReasonInvalidName)
+
+	assert.Equal(t, http.StatusNotFound, get("/presnap/allowed"))
+	assert.Equal(t, http.StatusNotFound, get("/register/allowed"), "the API must not bypass the allow-list")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/jobs/allowed", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.False(t, isKnownDataset(Job{JobName: "allowed"}))
+
+	// Registered at startup with --jobs.register.
+	require.NoError(t, (&Job{JobName: "allowed"}).RegisterMetric())
+	assert.Equal(t, http.StatusOK, get("/register/allowed?TargetHost=remote"))
+	assert.Equal(t, http.StatusOK, get("/presnap//allowed/"))
+	assert.Equal(t, http.StatusBadRequest, get("/presnap/allowed@snap"))
+
+	assert.EqualValues(t, unknown+1, rejected(RejectReasonUnknownJob))
+	assert.EqualValues(t, invalid+1, rejected(RejectReasonInvalidName))
+}
+
+func Test_handleMetrics(t *testing.T) {
+	r := SetupRouter()
+	for _, query := range []string{"/presnap/pool?Snapshot=snap-1", "/postsnap/pool?Snapshot=snap-1"} {
+		req := httptest.NewRequest("GET", query, nil)
+		req.Header.Set(requestIDHeader, "abc")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, "abc", w.Header().Get(requestIDHeader))
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/openmetrics-text")
+	for _, label := range []string{`request_id="abc"`, `snapshot="snap-1"`} {
+		assert.Regexp(t, `znapzend_hook_calls_total{job="pool",phase="postsnap"} \d+\.0 # {[^}]*`+label, w.Body.String())
+		assert.Regexp(t, `znapzend_snapshot_duration_seconds_bucket{job="pool",le="1.0"} \d+ # {[^}]*`+label, w.Body.String())
+	}
+	assert.Regexp(t, `znapzend_hook_calls_created{job="pool",phase="postsnap"} \d`, w.Body.String())
+	assert.Regexp(t, `znapzend_snapshot_duration_seconds_created{job="pool"} \d`, w.Body.String())
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	defer func() {
+		for _, vec := range metricVector {
+			vec.DeleteLabelValues("instrumented/a")
+			vec.DeleteLabelValues("instrumented/b")
+		}
+	}()
+	r := SetupRouter()
+	before := testutil.ToFloat64(httpRequestsMetric.WithLabelValues("/presnap/*job", "200"))
+	for _, query := range []string{"/presnap/instrumented/a", "/presnap/instrumented/b", "/does/not/exist"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", query, nil))
+	}
+
+	assert.EqualValues(t, before+2, testutil.ToFloat64(httpRequestsMetric.WithLabelValues("/presnap/*job", "200")))
+	assert.EqualValues(t, 1, testutil.ToFloat64(httpRequestsMetric.WithLabelValues("unmatched", "404")))
+	assert.Equal(t, 1, testutil.CollectAndCount(buildInfoMetric, "znapzend_exporter_build_info"))
+}
+
+func Test_handleCommands_RunID(t *testing.T) {
+	defer func() {
+		for _, vec := range metricVector {
+			vec.DeleteLabelValues("paired")
+		}
+		hooksConfig = CreateDefaultConfig().Hooks
+	}()
+	r := SetupRouter()
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", query, nil))
+		return w
+	}
+
+	w := get("/presnap/paired")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Regexp(t, `"run_id":"[0-9a-f]{16}"`, w.Body.String())
+
+	w = get("/presnap/paired?RunID=backup-42")
+	assert.JSONEq(t, `{"status":"applied","job":"paired","run_id":"backup-42"}`, w.Body.String())
+	assert.Equal(t, http.StatusBadRequest, get("/postsnap/paired?RunID=not/valid").Code)
+
+	hooksConfig.RequireRunID = true
+	assert.Equal(t, http.StatusBadRequest, get("/postsnap/paired").Code)
+	w = get("/postsnap/paired?RunID=backup-42")
+	assert.JSONEq(t, `{"status":"applied","job":"paired","run_id":"backup-42"}`, w.Body.String())
+}
+
+func Test_handleCommands_ExitCode(t *testing.T) {
+	job := Job{JobName: "tank/failing"}
+	defer job.UnregisterMetric()
+	r := SetupRouter()
+	get := func(query string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", query, nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("/presend/tank/failing?TargetHost=remote&RunID=send-1"))
+	assert.Equal(t, http.StatusOK, get("/postsend/tank/failing?TargetHost=remote&RunID=send-1&ExitCode=3&Error=cannot+receive"))
+	assert.EqualValues(t, JobStateFailed, testutil.ToFloat64(sendStateMetric.WithLabelValues("tank/failing", "remote")))
+	assert.EqualValues(t, 1, testutil.ToFloat64(jobPhaseMetric.WithLabelValues("tank/failing", "remote", string(PhaseFailed))))
+	assert.EqualValues(t, 0, testutil.ToFloat64(jobPhaseMetric.WithLabelValues("tank/failing", "remote", string(PhasePreSend))))
+	assert.EqualValues(t, 1, testutil.ToFloat64(failedRunsMetric.WithLabelValues("tank/failing", string(PhasePreSend))))
+	assert.EqualValues(t, 1, testutil.ToFloat64(preSendMetric.WithLabelValues("tank/failing", "remote")), "the gauges are kept")
+	assert.EqualValues(t, 0, testutil.ToFloat64(postSendMetric.WithLabelValues("tank/failing", "remote")))
+
+	assert.Equal(t, http.StatusOK, get("/presend/tank/failing?TargetHost=remote"))
+	assert.Equal(t, http.StatusOK, get("/postsend/tank/failing?TargetHost=remote&ExitCode=0"))
+	assert.EqualValues(t, JobStateDone, testutil.ToFloat64(sendStateMetric.WithLabelValues("tank/failing", "remote")))
+	assert.Equal(t, http.StatusBadRequest, get("/postsend/tank/failing?TargetHost=remote&ExitCode=failed"))
+}
+
+func Test_applyHook_WhenApplyPanics_ThenUnlockMutex(t *testing.T) {
+	job := Job{JobName: "tank/panicking"}
+	defer job.UnregisterMetric()
+	context, _ := gin.CreateTestContext(httptest.NewRecorder())
+	context.Request = httptest.NewRequest("GET", "/presnap/tank/panicking", nil)
+	context.Set(parameterKey, job)
+
+	assert.Panics(t, func() {
+		applyHook(context, PhasePreSnap, func(job Job) {
+			panic("invalid label")
+		})
+	})
+	locked := make(chan struct{})
+	go func() {
+		hookMutex.Lock()
+		hookMutex.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("hookMutex is still locked after the panic")
+	}
+}
@@ -20,11 +20,30 @@ var (
 All flags can be read from Environment variables as well (replace . with _ , e.g. LOG_LEVEL).
 However, CLI flags take precedence.
 
+Subcommands (see "%[1]s <command> --help"):
+  exec      Run a command between the pre and post hooks and report its exit status
+  hook      Call a hook of the exporter, spooling the event while the exporter is unreachable
+  replay    Deliver the spooled events
+  rules     Print Prometheus alerting rules, a Grafana dashboard or rule tests
+
 `
+
+	// commands are the subcommands of the binary, all other arguments start the exporter.
+	commands = map[string]func(args []string) int{
+		"exec":   runExecCommand,
+		"hook":   runHookCommand,
+		"replay": runReplayCommand,
+		"rules":  runRulesCommand,
+	}
 )
 
 func main() {
 
+	if len(os.Args) > 1 {
+		if command, found := commands[os.Args[1]]; found {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, helpText, os.Args[0], version, commit, date)
 		flag.PrintDefaults()
@@ -46,12 +65,85 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	if err := SetupMetrics(cfg); err != nil {
+		log.WithError(err).Fatal("Could not setup metrics.")
+	}
+	hooksConfig = cfg.Hooks
+	jobsConfig = cfg.Jobs
+	if cfg.Jobs.InitialState != InitialStateUnknown && cfg.Jobs.InitialState != InitialStateDone {
+		log.WithField("state", cfg.Jobs.InitialState).Fatal("Unknown initial state of jobs.")
+	}
+	parsedSchedules, err := parseSchedules(cfg.Jobs.Schedule)
+	if err != nil {
+		log.WithError(err).Fatal("Could not parse schedules.")
+	}
+	schedules = parsedSchedules
+	scheduleGrace = cfg.Jobs.ScheduleGrace
+	limitsConfig = cfg.Limits
+	clientLimiter = NewRateLimiter(cfg.RateLimit.ClientRate, cfg.RateLimit.ClientBurst)
+	jobLimiter = NewRateLimiter(cfg.RateLimit.JobRate, cfg.RateLimit.JobBurst)
+	if cfg.Limits.SeriesTTL > 0 {
+		go RunEviction(cfg.Limits.SeriesTTL, make(chan struct{}))
+		log.WithField("ttl", cfg.Limits.SeriesTTL).Info("Enabled eviction of stale series.")
+	}
+
+	if cfg.Hooks.RunTimeout > 0 {
+		go RunExpiry(cfg.Hooks.RunTimeout, make(chan struct{}))
+	}
+
+	if len(schedules) > 0 {
+		go RunScheduleCheck(scheduleCheckInterval, make(chan struct{}))
+		log.WithField("jobs", len(schedules)).Info("Enabled detection of missed runs.")
+	}
+
+	windows, err := parseMaintenanceWindows(cfg.Maintenance.Window)
+	if err != nil {
+		log.WithError(err).Fatal("Could not parse maintenance windows.")
+	}
+	maintenanceWindows = windows
+	if cfg.Maintenance.Path != "" {
+		if err := loadSilences(cfg.Maintenance.Path); err != nil {
+			log.WithError(err).Fatal("Could not load silences.")
+		}
+	}
+	go RunMaintenance(maintenanceCheckInterval, make(chan struct{}))
+
+	for _, proxy := range cfg.TrustedProxies {
+		network, err := parseNetwork(proxy)
+		if err != nil {
+			log.WithField("proxy", proxy).WithError(err).Fatal("Could not parse trusted proxy.")
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+
+	if cfg.Tenants.Enabled {
+		t, err := NewTenantResolver(cfg.Tenants)
+		if err != nil {
+			log.WithError(err).Fatal("Could not setup multi-tenant mode.")
+		}
+		tenants = t
+		log.Info("Enabled multi-tenant mode.")
+	}
+
+	if cfg.State.Backend != "" {
+		backend, err := NewStateBackend(cfg.State)
+		if err != nil {
+			log.WithError(err).Fatal("Could not setup state backend.")
+		}
+		state = NewStateStore(backend)
+		state.Sync()
+		go state.Run(cfg.State.Interval, make(chan struct{}))
+		log.WithField("backend", cfg.State.Backend).Info("Enabled sharing state between replicas.")
+	}
+
 	for _, job := range cfg.Jobs.Register {
-		arr := strings.Split(job, "@")
-		j := Job{JobName: arr[0]}
-		if len(arr) >= 2 {
-			j.TargetHost = arr[1]
+		j := parseJobSpec(job, cfg.Tenants.Enabled)
+		name, err := normalizeJobName(j.JobName)
+		if err != nil {
+			log.WithField("job", job).WithError(err).Warn("Failed to register job.")
+			continue
 		}
+		j.JobName = name
 		if err := j.RegisterMetric(); err != nil {
 			log.WithField("job", job).WithError(err).Warn("Failed to register job.")
 		} else {
@@ -59,19 +151,66 @@ func main() {
 		}
 	}
 
+	if len(cfg.Notify.URL) > 0 {
+		n, err := NewNotifier(cfg.Notify)
+		if err != nil {
+			log.WithError(err).Fatal("Could not setup notifications.")
+		}
+		notifier = n
+		log.WithField("urls", cfg.Notify.URL).Info("Enabled webhook notifications.")
+	}
+
+	if cfg.Audit.Path != "" {
+		a, err := NewAuditLog(cfg.Audit.Path, int64(cfg.Audit.MaxSize)*1024*1024, cfg.Audit.MaxBackups)
+		if err != nil {
+			log.WithError(err).Fatal("Could not open audit log.")
+		}
+		audit = a
+		log.WithField("path", cfg.Audit.Path).Info("Enabled audit log.")
+	}
+
+	if cfg.Push.URL != "" {
+		p, err := NewPusher(cfg.Push, gatherer)
+		if err != nil {
+			log.WithError(err).Fatal("Could not setup pushing metrics.")
+		}
+		go p.Run(make(chan struct{}))
+		log.WithFields(log.Fields{"url": cfg.Push.URL, "mode": cfg.Push.Mode}).Info("Enabled pushing metrics.")
+	}
+
 	log.WithField("port", cfg.BindAddr).Info("Starting webserver.")
 	r := SetupRouter()
-	err := r.Run(cfg.BindAddr)
+	err = r.Run(cfg.BindAddr)
 	log.WithError(err).Fatal("Shutting down.")
 }
 
+// parseJobSpec parses a job given in the form [source_host:]dataset[@target_host]. The source host is only parsed in
+// multi-tenant mode, as dataset names may contain colons.
+func parseJobSpec(spec string, withSourceHost bool) Job {
+	j := Job{}
+	if i := strings.Index(spec, ":"); withSourceHost && i >= 0 {
+		j.SourceHost = spec[:i]
+		spec = spec[i+1:]
+	}
+	arr := strings.Split(spec, "@")
+	j.JobName = arr[0]
+	if len(arr) >= 2 {
+		j.TargetHost = arr[1]
+	}
+	return j
+}
+
 // SetupRouter initializes Gin with the handlers.
 func SetupRouter() *gin.Engine {
 	r := gin.New()
 	r.Use(
+		InstrumentHandler(),
+		RequestIDHandler(),
 		LogrusHandler(),
 		ErrorHandle(),
-		InputValidationHandle("/pre", "/post", "/register", "/unregister"),
+		InputValidationHandle("/pre", "/post", "/progress", "/register", "/unregister", "/api/v1/jobs/"),
+		TenantHandle(),
+		RateLimitHandle(),
 		gin.Recovery(),
 	)
 	r.GET("/", handleRoot)
@@ -79,10 +218,18 @@ func SetupRouter() *gin.Engine {
 	r.GET("/postsnap/*job", handlePostSnap)
 	r.GET("/presend/*job", handlePreSend)
 	r.GET("/postsend/*job", handlePostSend)
+	r.GET("/progress/*job", handleProgress)
 	r.GET("/register/*job", handleRegister)
 	r.GET("/unregister/*job", handleUnregister)
+	r.GET("/api/v1/jobs", handleListJobs)
+	r.GET("/api/v1/jobs/*job", handleGetJob)
+	r.PUT("/api/v1/jobs/*job", handlePutJob)
+	r.DELETE("/api/v1/jobs/*job", handleDeleteJob)
+	r.POST("/api/v1/jobs/*job", handlePostJob)
 	r.GET("/health/ready", handleHealthcheck)
 	r.GET("/health/alive", handleHealthcheck)
 	r.GET("/metrics", handleMetrics)
+	r.GET("/state", handleGetState)
+	r.POST("/state", handlePostState)
 	return r
 }
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maintenanceCheckInterval is the interval in which the silenced gauges are updated and expired silences removed.
+	maintenanceCheckInterval = time.Minute
+	// silenceSuffix is the suffix of the job path that silences the job.
+	silenceSuffix = "/silence"
+)
+
+var (
+	// maintenanceWindows contains the recurring maintenance windows of the config.
+	maintenanceWindows []maintenanceWindow
+	// silences contains the end of the silences set through the API by silenceKey.
+	silences      = make(map[string]silence)
+	silencesMutex sync.Mutex
+	// silencesPath is the file the silences are persisted to. Empty disables persistence.
+	silencesPath string
+
+	weekdays = map[string]time.Weekday{
+		"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+		"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+	}
+)
+
+type (
+	// maintenanceWindow is a recurring window in local time during which the matching jobs are silenced.
+	maintenanceWindow struct {
+		pattern  string
+		days     [7]bool
+		start    time.Duration
+		duration time.Duration
+	}
+	// silence is a silence of a job set through the API.
+	silence struct {
+		SourceHost string    `json:"source_host,omitempty"`
+		Job        string    `json:"job"`
+		Until      time.Time `json:"until"`
+	}
+)
+
+// parseMaintenanceWindows parses a list of windows in the form pattern=days HH:MM-HH:MM, e.g. "tank/*=Sat-Sun
+// 02:00-06:00". The pattern is matched against the job and its parents, days is "daily", a weekday or a range of
+// weekdays. A window that ends before it starts ends on the next day.
+func parseMaintenanceWindows(specs []string) ([]maintenanceWindow, error) {
+	var result []maintenanceWindow
+	for _, spec := range specs {
+		arr := strings.SplitN(spec, "=", 2)
+		if len(arr) != 2 || arr[0] == "" {
+			return nil, fmt.Errorf("invalid maintenance window %q, expected pattern=days HH:MM-HH:MM", spec)
+		}
+		if _, err := path.Match(arr[0], ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern of maintenance window %q: %v", spec, err)
+		}
+		fields := strings.Fields(arr[1])
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid maintenance window %q, expected pattern=days HH:MM-HH:MM", spec)
+		}
+		w := maintenanceWindow{pattern: strings.TrimSuffix(arr[0], "/")}
+		if err := w.parseDays(fields[0]); err != nil {
+			return nil, fmt.Errorf("invalid days of maintenance window %q: %v", spec, err)
+		}
+		times := strings.Split(fields[1], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid times of maintenance window %q, expected HH:MM-HH:MM", spec)
+		}
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, err
+		}
+		w.start, w.duration = start, end-start
+		if w.duration <= 0 {
+			w.duration += 24 * time.Hour
+		}
+		result = append(result, w)
+	}
+	return result, nil
+}
+
+// parseDays parses "daily", a weekday like "Sun" or a range of weekdays like "Mon-Fri".
+func (w *maintenanceWindow) parseDays(value string) error {
+	value = strings.ToLower(value)
+	if value == "daily" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+	arr := strings.Split(value, "-")
+	if len(arr) > 2 {
+		return fmt.Errorf("expected daily, a weekday or a range of weekdays: %s", value)
+	}
+	first, found := weekdays[arr[0]]
+	if !found {
+		return fmt.Errorf("unknown weekday: %s", arr[0])
+	}
+	last := first
+	if len(arr) == 2 {
+		if last, found = weekdays[arr[1]]; !found {
+			return fmt.Errorf("unknown weekday: %s", arr[1])
+		}
+	}
+	for day := first; ; day = (day + 1) % 7 {
+		w.days[day] = true
+		if day == last {
+			return nil
+		}
+	}
+}
+
+// parseTimeOfDay parses a time like "02:30" into the duration since midnight.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day, expected HH:MM: %s", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// matches returns true if the pattern of the window matches the job or one of its parents.
+func (w maintenanceWindow) matches(name string) bool {
+	for ; name != ""; name = parentOf(name) {
+		if matched, _ := path.Match(w.pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// active returns true if the given time lies within the window. Windows that started on the previous day are
+// considered as well.
+func (w maintenanceWindow) active(t time.Time) bool {
+	t = t.Local()
+	for _, offset := range []int{0, -1} {
+		day := time.Date(t.Year(), t.Month(), t.Day()+offset, 0, 0, 0, 0, time.Local)
+		if !w.days[day.Weekday()] {
+			continue
+		}
+		start := day.Add(w.start)
+		if !t.Before(start) && t.Before(start.Add(w.duration)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSilenced returns true if the job is silenced through the API or within a maintenance window at the given time.
+func isSilenced(job Job, at time.Time) bool {
+	if until, found := silencedUntil(job); found && at.Before(until) {
+		return true
+	}
+	for _, w := range maintenanceWindows {
+		if w.matches(job.JobName) && w.active(at) {
+			return true
+		}
+	}
+	return false
+}
+
+// silencedUntil returns the end of the silence of the job set through the API, or false if there is none.
+func silencedUntil(job Job) (time.Time, bool) {
+	silencesMutex.Lock()
+	defer silencesMutex.Unlock()
+	s, found := silences[silenceKey(job)]
+	return s.Until, found
+}
+
+// silenceJob silences the job until the given time, or lifts its silence if the time has passed, and persists the
+// silences. Returns a seriesLimitError if the job is not silenced yet and as many jobs as allowed are silenced.
+func silenceJob(job Job, until time.Time) error {
+	silencesMutex.Lock()
+	defer silencesMutex.Unlock()
+	key := silenceKey(job)
+	if until.After(time.Now()) {
+		if _, found := silences[key]; !found && limitsConfig.MaxJobs > 0 && len(silences) >= limitsConfig.MaxJobs {
+			seriesRejectedMetric.WithLabelValues(LimitMaxJobs).Inc()
+			return seriesLimitError{fmt.Errorf("limit of %d silenced jobs reached", limitsConfig.MaxJobs), LimitMaxJobs}
+		}
+		silences[key] = silence{SourceHost: job.SourceHost, Job: job.JobName, Until: until}
+	} else {
+		delete(silences, key)
+	}
+	return saveSilences()
+}
+
+// forgetSilence lifts the silence of the job, if any, once it is unregistered or evicted.
+func (p *Job) forgetSilence() {
+	silencesMutex.Lock()
+	defer silencesMutex.Unlock()
+	if _, found := silences[silenceKey(*p)]; !found {
+		return
+	}
+	delete(silences, silenceKey(*p))
+	if err := saveSilences(); err != nil {
+		log.WithField("path", silencesPath).WithError(err).Warn("Could not save silences.")
+	}
+}
+
+// RunMaintenance updates the silenced gauges and removes the expired silences until stop is closed.
+func RunMaintenance(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			updateSilenced(now)
+		}
+	}
+}
+
+// updateSilenced removes the expired silences and sets the silenced gauge of all known jobs that are or have been
+// silenced, or that are matched by a maintenance window.
+func updateSilenced(now time.Time) {
+	silencesMutex.Lock()
+	expired := false
+	for key, s := range silences {
+		if !now.Before(s.Until) {
+			delete(silences, key)
+			expired = true
+		}
+	}
+	if expired {
+		if err := saveSilences(); err != nil {
+			log.WithField("path", silencesPath).WithError(err).Warn("Could not save silences.")
+		}
+	}
+	silencesMutex.Unlock()
+
+	datasets := listDatasets()
+	hookMutex.Lock()
+	defer hookMutex.Unlock()
+	for _, info := range datasets {
+		job := Job{JobName: info.Job, SourceHost: info.SourceHost}
+		job.updateSilenced(now)
+	}
+}
+
+// updateSilenced sets the silenced gauge of the job if the job is silenced, has been silenced before or is matched by a
+// maintenance window. hookMutex has to be held.
+func (p *Job) updateSilenced(now time.Time) {
+	silenced := isSilenced(*p, now)
+	tracked := silenced || gaugeValue(jobSilencedMetric, p.labelValues()) != nil
+	for _, w := range maintenanceWindows {
+		tracked = tracked || w.matches(p.JobName)
+	}
+	if !tracked {
+		return
+	}
+	value := 0.0
+	if silenced {
+		value = 1
+	}
+	gauge, err := jobSilencedMetric.GetMetricWithLabelValues(p.labelValues()...)
+	if err != nil {
+		p.logger().WithError(err).Warn("Could not set silenced gauge.")
+		return
+	}
+	gauge.Set(value)
+	trackGauge(jobSilencedMetric, p.labelValues(), gauge)
+}
+
+// loadSilences reads the silences from the given file and persists them there from then on. A missing file is not an
+// error.
+func loadSilences(file string) error {
+	silencesMutex.Lock()
+	defer silencesMutex.Unlock()
+	silencesPath = file
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []silence
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, s := range list {
+		if now.Before(s.Until) {
+			silences[silenceKey(Job{SourceHost: s.SourceHost, JobName: s.Job})] = s
+		}
+	}
+	return nil
+}
+
+// saveSilences writes the silences to the file, replacing it atomically. silencesMutex has to be held.
+func saveSilences() error {
+	if silencesPath == "" {
+		return nil
+	}
+	list := make([]silence, 0, len(silences))
+	for _, s := range silences {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return silenceKey(Job{SourceHost: list[i].SourceHost, JobName: list[i].Job}) <
+			silenceKey(Job{SourceHost: list[j].SourceHost, JobName: list[j].Job})
+	})
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := silencesPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, silencesPath)
+}
+
+// silenceKey returns the key of the silence of the job.
+func silenceKey(job Job) string {
+	return job.SourceHost + "|" + job.JobName
+}
+
+// handlePostJob handles the actions on a registered job, of which only silencing (path suffix /silence) exists. The end
+// of the silence is given by the until parameter as RFC3339, Unix time or a duration like 2h. An end in the past lifts
+// the silence.
+func handlePostJob(context *gin.Context) {
+	job := context.MustGet(parameterKey).(Job)
+	if !strings.HasSuffix(job.JobName, silenceSuffix) {
+		context.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("unknown action on job: %s", job.JobName)})
+		return
+	}
+	job.JobName = strings.TrimSuffix(job.JobName, silenceSuffix)
+	now := time.Now()
+	until, err := parseUntil(context.Query("until"), now)
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hookMutex.Lock()
+	defer hookMutex.Unlock()
+	if !isKnownDataset(job) {
+		context.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("job is not registered: %s", job.JobName)})
+		return
+	}
+	before := map[Phase]*float64{gaugeSilenced: gaugeValue(jobSilencedMetric, job.labelValues())}
+	if err := silenceJob(job, until); err != nil {
+		if _, limited := err.(seriesLimitError); limited {
+			audit.Record(context, job, AuditResultRejected, before, before)
+			context.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		SetLogWithFields(context, log.ErrorLevel, "Could not save silences.", log.Fields{"error": err})
+	}
+	job.updateSilenced(now)
+	audit.Record(context, job, AuditResultSilenced, before,
+		map[Phase]*float64{gaugeSilenced: gaugeValue(jobSilencedMetric, job.labelValues())})
+
+	response := gin.H{"job": job.JobName, "silenced": until.After(now)}
+	if until.After(now) {
+		response["until"] = until
+	}
+	context.JSON(http.StatusOK, response)
+}
+
+// parseUntil parses the end of a silence given as RFC3339, Unix time or a duration relative to now.
+func parseUntil(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("missing until parameter in query")
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(d), nil
+	}
+	t, err := parseTimestamp(value)
+	if err != nil {
+		return t, fmt.Errorf("invalid until, expected RFC3339, Unix time or a duration: %s", value)
+	}
+	return t, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_parseMaintenanceWindows(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		days     []time.Weekday
+		duration time.Duration
+		wantErr  bool
+	}{
+		{name: "Daily", spec: "tank=daily 01:00-02:30", duration: 90 * time.Minute,
+			days: []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday}},
+		{name: "Weekday", spec: "tank/*=Sun 02:00-06:00", duration: 4 * time.Hour, days: []time.Weekday{time.Sunday}},
+		{name: "RangeAcrossWeekend", spec: "*=Fri-Mon 22:00-02:00", duration: 4 * time.Hour,
+			days: []time.Weekday{time.Sunday, time.Monday, time.Friday, time.Saturday}},
+		{name: "MissingTimes", spec: "tank=daily", wantErr: true},
+		{name: "UnknownWeekday", spec: "tank=Someday 01:00-02:00", wantErr: true},
+		{name: "InvalidTime", spec: "tank=daily 25:00-26:00", wantErr: true},
+		{name: "InvalidPattern", spec: "tank/[=daily 01:00-02:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			windows, err := parseMaintenanceWindows([]string{tt.spec})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, windows, 1)
+			var days []time.Weekday
+			for day, enabled := range windows[0].days {
+				if enabled {
+					days = append(days, time.Weekday(day))
+				}
+			}
+			assert.Equal(t, tt.days, days)
+			assert.Equal(t, tt.duration, windows[0].duration)
+		})
+	}
+}
+
+func Test_maintenanceWindow(t *testing.T) {
+	windows, err := parseMaintenanceWindows([]string{"tank/*=Sat-Sun 22:00-02:00"})
+	require.NoError(t, err)
+	w := windows[0]
+
+	// 2026-10-17 is a Saturday.
+	at := func(day, hour int) time.Time {
+		return time.Date(2026, 10, day, hour, 30, 0, 0, time.Local)
+	}
+	assert.True(t, w.active(at(17, 23)))
+	assert.True(t, w.active(at(18, 1)), "the window of Saturday ends on Sunday")
+	assert.True(t, w.active(at(19, 1)), "the window of Sunday ends on Monday")
+	assert.False(t, w.active(at(19, 3)))
+	assert.False(t, w.active(at(16, 23)))
+	assert.False(t, w.active(at(17, 21)))
+
+	assert.True(t, w.matches("tank/data"))
+	assert.True(t, w.matches("tank/data/child"))
+	assert.False(t, w.matches("tank"))
+	assert.False(t, w.matches("backup/data"))
+}
+
+func TestSilenceAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "silences")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "silences.json")
+	require.NoError(t, loadSilences(file))
+	job := Job{JobName: "tank/maintained", TargetHost: "remote"}
+	defer func() {
+		silencesPath = ""
+		silences = make(map[string]silence)
+		schedules = make(map[string]time.Duration)
+		job.TargetHost = ""
+		job.UnregisterMetric()
+	}()
+	schedules = map[string]time.Duration{"tank/maintained": time.Hour}
+	require.NoError(t, job.RegisterMetric())
+	r := SetupRouter()
+	post := func(query string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", query, nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("/api/v1/jobs/tank/maintained/silence?until=4h"))
+	assert.EqualValues(t, 1, testutil.ToFloat64(jobSilencedMetric.WithLabelValues("tank/maintained")))
+	assert.True(t, isSilenced(job, time.Now().Add(3*time.Hour)))
+	assert.False(t, isSilenced(job, time.Now().Add(5*time.Hour)))
+	assert.Zero(t, checkSchedules(time.Now().Add(3*time.Hour)), "missed runs are not counted during maintenance")
+	assert.Equal(t, 2, checkSchedules(time.Now().Add(5*time.Hour)))
+
+	// The silence survives a restart.
+	silences = make(map[string]silence)
+	require.NoError(t, loadSilences(file))
+	_, found := silencedUntil(job)
+	assert.True(t, found)
+
+	assert.Equal(t, http.StatusOK, post("/api/v1/jobs/tank/maintained/silence?until=0"))
+	assert.EqualValues(t, 0, testutil.ToFloat64(jobSilencedMetric.WithLabelValues("tank/maintained")))
+	assert.False(t, isSilenced(job, time.Now()))
+	silences = make(map[string]silence)
+	require.NoError(t, loadSilences(file))
+	assert.Empty(t, silences)
+
+	assert.Equal(t, http.StatusBadRequest, post("/api/v1/jobs/tank/maintained/silence?until=tomorrow"))
+	assert.Equal(t, http.StatusBadRequest, post("/api/v1/jobs/tank/maintained/silence"))
+	assert.Equal(t, http.StatusNotFound, post("/api/v1/jobs/tank/maintained"))
+	assert.Equal(t, http.StatusNotFound, post("/api/v1/jobs/tank/unknown/silence?until=4h"))
+	assert.Empty(t, silences, "unknown jobs are not silenced")
+
+	other := Job{JobName: "tank/other"}
+	require.NoError(t, other.RegisterMetric())
+	defer other.UnregisterMetric()
+	limitsConfig.MaxJobs = 1
+	defer func() {
+		limitsConfig = CreateDefaultConfig().Limits
+	}()
+	assert.Equal(t, http.StatusOK, post("/api/v1/jobs/tank/maintained/silence?until=4h"))
+	assert.Equal(t, http.StatusUnprocessableEntity, post("/api/v1/jobs/tank/other/silence?until=4h"))
+	assert.Equal(t, http.StatusOK, post("/api/v1/jobs/tank/maintained/silence?until=5h"), "existing silences are extended")
+
+	job.TargetHost = ""
+	job.UnregisterMetric()
+	assert.Empty(t, silences, "the silence of an unregistered job is lifted")
+}
+
+func Test_updateSilenced(t *testing.T) {
+	job := Job{JobName: "tank/expiring"}
+	defer func() {
+		silences = make(map[string]silence)
+		job.UnregisterMetric()
+	}()
+	require.NoError(t, job.RegisterMetric())
+	require.NoError(t, silenceJob(job, time.Now().Add(time.Hour)))
+
+	updateSilenced(time.Now())
+	assert.EqualValues(t, 1, testutil.ToFloat64(jobSilencedMetric.WithLabelValues("tank/expiring")))
+	updateSilenced(time.Now().Add(2 * time.Hour))
+	assert.EqualValues(t, 0, testutil.ToFloat64(jobSilencedMetric.WithLabelValues("tank/expiring")))
+	_, found := silencedUntil(job)
+	assert.False(t, found, "expired silences are removed")
+}
@@ -1,38 +1,116 @@
 package main
 
 import (
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
 	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 var (
-	namespace     = "znapzend"
-	preSnapMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Name:      "presnap_command_started",
-		Help:      "whether the command to run prior zfs snapshot was started",
-	}, []string{"job"})
-	postSnapMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Name:      "postsnap_command_finished",
-		Help:      "whether the command to run after zfs snapshot was finished",
-	}, []string{"job"})
-	preSendMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Name:      "presend_command_started",
-		Help:      "whether the command to run prior zfs send was started",
-	}, []string{"job", "target_host"})
-	postSendMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Name:      "postsend_command_finished",
-		Help:      "whether the command to run after zfs send was finished",
-	}, []string{"job", "target_host"})
-	metricVector = []*prometheus.GaugeVec{preSnapMetric, postSnapMetric, preSendMetric, postSendMetric}
+	preSnapMetric           *prometheus.GaugeVec
+	postSnapMetric          *prometheus.GaugeVec
+	preSendMetric           *prometheus.GaugeVec
+	postSendMetric          *prometheus.GaugeVec
+	metricVector            []*prometheus.GaugeVec
+	snapshotDurationMetric  *prometheus.HistogramVec
+	sendDurationMetric      *prometheus.HistogramVec
+	hookCallsMetric         *prometheus.CounterVec
+	hookRejectionsMetric    *prometheus.CounterVec
+	orphanedRunsMetric      *prometheus.CounterVec
+	failedRunsMetric        *prometheus.CounterVec
+	seriesEvictedMetric     prometheus.Counter
+	seriesRejectedMetric    *prometheus.CounterVec
+	throttledRequestsMetric *prometheus.CounterVec
+	httpRequestsMetric      *prometheus.CounterVec
+	httpDurationMetric      *prometheus.HistogramVec
+	buildInfoMetric         *prometheus.GaugeVec
+	lastSnapshotMetric      *prometheus.GaugeVec
+	lastSendMetric          *prometheus.GaugeVec
+	snapshotStateMetric     *prometheus.GaugeVec
+	sendStateMetric         *prometheus.GaugeVec
+	jobPhaseMetric          *prometheus.GaugeVec
+	nextExpectedMetric      *prometheus.GaugeVec
+	missedRunsMetric        *prometheus.CounterVec
+	jobSilencedMetric       *prometheus.GaugeVec
+	sendProgressBytesMetric *prometheus.GaugeVec
+	sendProgressRatioMetric *prometheus.GaugeVec
+	sendCompletionMetric    *prometheus.GaugeVec
+
+	// jobsConfig contains the initial state of registered jobs.
+	jobsConfig = CreateDefaultConfig().Jobs
+
+	durationBuckets = prometheus.ExponentialBuckets(1, 4, 10)
+	// jobRegistry contains the metrics of the jobs. It is replaced by SetupMetrics, as the label names of a metric
+	// cannot change within the same registry.
+	jobRegistry *prometheus.Registry
+	// gatherer gathers the metrics of the jobs and the metrics of the default registry (Go runtime, process).
+	gatherer = prometheus.Gatherers{
+		prometheus.DefaultGatherer,
+		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			hookMutex.RLock()
+			defer hookMutex.RUnlock()
+			return jobRegistry.Gather()
+		}),
+	}
+	// derivedLabels contains the enabled labels whose values are derived from the job, e.g. from the dataset path.
+	derivedLabels []derivedLabel
+	// sourceHostLabeled is true if the first derived label is the source host of the multi-tenant mode.
+	sourceHostLabeled bool
+	// customLabelNames contains the names of the per-job labels, which are appended to the labels of all vectors.
+	customLabelNames []string
+	// customLabelValues contains the values of the per-job labels by job name.
+	customLabelValues map[string]map[string]string
+	// jobPhases contains the phases of the job phase stateset.
+	jobPhases = []Phase{PhaseUnknown, PhasePreSnap, PhasePostSnap, PhasePreSend, PhasePostSend, PhaseFailed}
+
+	// hookMutex is held while a hook is applied and while the metrics of the jobs are gathered.
+	hookMutex sync.RWMutex
+
+	// gaugeSeries contains the existing series of the gauge vectors of the jobs by seriesKey, so that a single series
+	// can be read without collecting the whole vector.
+	gaugeSeries      map[*prometheus.GaugeVec]map[string]prometheus.Gauge
+	gaugeSeriesMutex sync.Mutex
+
+	// resetTimers contains the pending resets by gauge.
+	resetTimers      = make(map[prometheus.Gauge]*time.Timer)
+	resetTimersMutex sync.Mutex
+
+	// runStarts contains the runs that have been started but not finished yet by runKey, in the order they started.
+	runStarts      = make(map[string][]startedRun)
+	runStartsMutex sync.Mutex
+	// latestEvents contains the time of the latest applied event by job and, for sends, by target host.
+	latestEvents      = make(map[string]time.Time)
+	latestEventsMutex sync.Mutex
+)
+
+const (
+	// maxExemplarRunes is the maximum combined length of the exemplar label names and values allowed by OpenMetrics.
+	maxExemplarRunes = 128
+	// maxStartedRuns is the maximum number of unfinished runs per job, phase and target host. Beyond, the run that
+	// started first is counted as orphaned.
+	maxStartedRuns = 16
 )
 
 type (
+	// derivedLabel is a label whose value is derived from the job.
+	derivedLabel struct {
+		name  string
+		value func(p *Job) string
+	}
+	// startedRun is a snapshot or send that has been started by a pre hook.
+	startedRun struct {
+		id      string
+		job     Job
+		phase   Phase
+		started time.Time
+	}
 	// ResetMetricTuple contains a gauge and its enable flag.
 	ResetMetricTuple struct {
 		resetEnabled bool
@@ -41,29 +119,381 @@ type (
 	}
 )
 
+func init() {
+	// Metric and label names are restricted to the classic character set, which all Prometheus versions can scrape.
+	model.NameValidationScheme = model.LegacyValidation
+	if err := SetupMetrics(CreateDefaultConfig()); err != nil {
+		panic(err)
+	}
+}
+
+// SetupMetrics creates and registers all metric vectors with the namespace and labels of the given config. Metrics
+// that have been set up previously are replaced, thus it should only be called during startup.
+func SetupMetrics(config ConfigMap) error {
+	cfg := config.Metrics
+	constLabels, err := parseLabelPairs(cfg.ConstLabels)
+	if err != nil {
+		return err
+	}
+	names, values, err := parseJobLabels(cfg.JobLabels)
+	if err != nil {
+		return err
+	}
+	customLabelNames, customLabelValues = names, values
+	derivedLabels = nil
+	sourceHostLabeled = config.Tenants.Enabled
+	if config.Tenants.Enabled {
+		derivedLabels = append(derivedLabels, derivedLabel{config.Tenants.Label, func(p *Job) string {
+			return p.SourceHost
+		}})
+	}
+	if cfg.PoolLabels {
+		derivedLabels = append(derivedLabels, derivedLabel{"pool", func(p *Job) string {
+			return poolOf(p.JobName)
+		}}, derivedLabel{"dataset", func(p *Job) string {
+			return datasetOf(p.JobName)
+		}})
+	}
+	if cfg.ParentLabel {
+		derivedLabels = append(derivedLabels, derivedLabel{"parent", func(p *Job) string {
+			return parentOf(p.JobName)
+		}})
+	}
+	for i := len(derivedLabels) - 1; i >= 0; i-- {
+		names = append([]string{derivedLabels[i].name}, names...)
+	}
+
+	snapLabels := append([]string{cfg.DatasetLabel}, names...)
+	sendLabels := append([]string{cfg.DatasetLabel, "target_host"}, names...)
+	phaseLabels := append([]string{cfg.DatasetLabel, "target_host", "phase"}, names...)
+	gaugeOpts := func(name, help string) prometheus.GaugeOpts {
+		return prometheus.GaugeOpts{Namespace: cfg.Namespace, Name: name, Help: help, ConstLabels: constLabels}
+	}
+	histogramOpts := func(name, help string) prometheus.HistogramOpts {
+		return prometheus.HistogramOpts{
+			Namespace: cfg.Namespace, Name: name, Help: help, ConstLabels: constLabels, Buckets: durationBuckets,
+		}
+	}
+
+	preSnapMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"presnap_command_started", "whether the command to run prior zfs snapshot was started"), snapLabels)
+	postSnapMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"postsnap_command_finished", "whether the command to run after zfs snapshot was finished"), snapLabels)
+	preSendMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"presend_command_started", "whether the command to run prior zfs send was started"), sendLabels)
+	postSendMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"postsend_command_finished", "whether the command to run after zfs send was finished"), sendLabels)
+	metricVector = []*prometheus.GaugeVec{preSnapMetric, postSnapMetric, preSendMetric, postSendMetric}
+	snapshotDurationMetric = prometheus.NewHistogramVec(histogramOpts(
+		"snapshot_duration_seconds", "duration between the pre and post snapshot commands"), snapLabels)
+	sendDurationMetric = prometheus.NewHistogramVec(histogramOpts(
+		"send_duration_seconds", "duration between the pre and post send commands"), sendLabels)
+	hookCallsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.Namespace,
+		Name:        "hook_calls_total",
+		Help:        "number of calls to the snapshot and send commands",
+		ConstLabels: constLabels,
+	}, append([]string{cfg.DatasetLabel, "phase"}, names...))
+	orphanedRunsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.Namespace,
+		Name:        "orphaned_runs_total",
+		Help:        "number of started snapshots and sends whose post command did not arrive within the run timeout",
+		ConstLabels: constLabels,
+	}, append([]string{cfg.DatasetLabel, "phase"}, names...))
+	failedRunsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.Namespace,
+		Name:        "failed_runs_total",
+		Help:        "number of snapshots and sends whose post command reported a non-zero exit code",
+		ConstLabels: constLabels,
+	}, append([]string{cfg.DatasetLabel, "phase"}, names...))
+	// The rejected calls are not labelled by job, as invalid job names would create new series.
+	hookRejectionsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.Namespace,
+		Name:        "hook_calls_rejected_total",
+		Help:        "number of rejected calls to the snapshot and send commands by reason",
+		ConstLabels: constLabels,
+	}, []string{"phase", "reason"})
+	seriesEvictedMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   cfg.Namespace,
+		Name:        "series_evicted_total",
+		Help:        "number of series deleted because their job or target host has not been updated within the TTL",
+		ConstLabels: constLabels,
+	})
+	seriesRejectedMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.Namespace,
+		Name:        "series_rejected_total",
+		Help:        "number of jobs and target hosts rejected because the limit has been reached",
+		ConstLabels: constLabels,
+	}, []string{"limit"})
+	throttledRequestsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.Namespace,
+		Name:        "throttled_requests_total",
+		Help:        "number of hook calls and progress reports rejected because the rate limit of the client or job has been exceeded",
+		ConstLabels: constLabels,
+	}, []string{"phase", "limit"})
+
+	snapshotStateMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"snapshot_state", "state of the zfs snapshot: 0 unknown, 1 in progress, 2 done, 3 failed"), snapLabels)
+	sendStateMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"send_state", "state of the zfs send: 0 unknown, 1 in progress, 2 done, 3 failed"), sendLabels)
+	jobPhaseMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"job_phase", "current phase of the job, exactly one phase is 1"), phaseLabels)
+	sendProgressBytesMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"send_progress_bytes", "number of bytes sent by the running zfs send"), sendLabels)
+	sendProgressRatioMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"send_progress_ratio", "ratio of the total bytes sent by the running zfs send"), sendLabels)
+	sendCompletionMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"send_estimated_completion_timestamp_seconds", "estimated time of completion of the running zfs send"), sendLabels)
+	jobSilencedMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"job_silenced", "whether the job is silenced through the API or within a maintenance window"), snapLabels)
+	gaugeSeries = make(map[*prometheus.GaugeVec]map[string]prometheus.Gauge)
+	lastSnapshotMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"last_snapshot_success_timestamp_seconds", "time of the last finished zfs snapshot"), snapLabels)
+	lastSendMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"last_send_success_timestamp_seconds", "time of the last finished zfs send"), sendLabels)
+	// The schedule of the snapshots is labelled with an empty target host, as in the job phase.
+	nextExpectedMetric = prometheus.NewGaugeVec(gaugeOpts(
+		"job_next_expected_timestamp", "time in seconds by which the next snapshot or send is expected to finish according to the schedule"), sendLabels)
+	missedRunsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.Namespace,
+		Name:        "job_missed_runs_total",
+		Help:        "number of scheduled snapshots and sends that did not finish within their window",
+		ConstLabels: constLabels,
+	}, sendLabels)
+
+	// The metrics of the exporter itself are labelled by route template, not by path, to avoid a series per job.
+	httpRequestsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   cfg.Namespace,
+		Subsystem:   "exporter",
+		Name:        "http_requests_total",
+		Help:        "number of HTTP requests by route and status code",
+		ConstLabels: constLabels,
+	}, []string{"route", "code"})
+	httpDurationMetric = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   cfg.Namespace,
+		Subsystem:   "exporter",
+		Name:        "http_request_duration_seconds",
+		Help:        "duration of HTTP requests by route",
+		ConstLabels: constLabels,
+		Buckets:     prometheus.DefBuckets,
+	}, []string{"route"})
+	buildInfoMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   cfg.Namespace,
+		Subsystem:   "exporter",
+		Name:        "build_info",
+		Help:        "build information of the exporter, the value is always 1",
+		ConstLabels: constLabels,
+	}, []string{"version", "commit", "date"})
+	buildInfoMetric.WithLabelValues(version, commit, date).Set(1)
+
+	collectors := []prometheus.Collector{
+		snapshotDurationMetric, sendDurationMetric, hookCallsMetric, hookRejectionsMetric, orphanedRunsMetric, failedRunsMetric, lastSnapshotMetric, lastSendMetric,
+		snapshotStateMetric, sendStateMetric, jobPhaseMetric, nextExpectedMetric, missedRunsMetric,
+		jobSilencedMetric, sendProgressBytesMetric, sendProgressRatioMetric, sendCompletionMetric,
+		seriesEvictedMetric, seriesRejectedMetric, throttledRequestsMetric,
+		httpRequestsMetric, httpDurationMetric, buildInfoMetric,
+	}
+	// The legacy gauges are still maintained if they are not exposed, as the resets, the shared state and the audit log
+	// rely on them.
+	if cfg.LegacyGauges {
+		collectors = append(collectors, preSnapMetric, postSnapMetric, preSendMetric, postSendMetric)
+	}
+	registry := prometheus.NewRegistry()
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+	jobRegistry = registry
+	return nil
+}
+
+// labelValues returns the label values of the job for a vector: The job name, followed by the given values, the derived
+// labels and the values of the per-job labels.
+func (p *Job) labelValues(values ...string) []string {
+	result := append([]string{p.JobName}, values...)
+	for _, label := range derivedLabels {
+		result = append(result, label.value(p))
+	}
+	for _, name := range customLabelNames {
+		result = append(result, customLabelValues[p.JobName][name])
+	}
+	return result
+}
+
 func (p *Job) setMetric(vec *prometheus.GaugeVec) {
-	gauge := vec.WithLabelValues(p.JobName)
-	p.setValue(gauge)
+	p.setValue(vec, p.labelValues())
 }
 
 func (p *Job) setMetricWithHost(vec *prometheus.GaugeVec) {
-	gauge := vec.With(prometheus.Labels{
-		"job":         p.JobName,
-		"target_host": p.TargetHost,
-	})
-	p.setValue(gauge)
+	p.setValue(vec, p.labelValues(p.TargetHost))
 }
 
-func (p *Job) setValue(gauge prometheus.Gauge) {
-	gauge.Set(1)
+func (p *Job) setValue(vec *prometheus.GaugeVec, values []string) {
+	var resetAt time.Time
 	if p.SelfResetAfter > 0 {
-		go func() {
-			logEntry := log.WithFields(log.Fields{"job": p.JobName})
-			logEntry.WithField("delay", p.SelfResetAfter).Debug("Delaying job reset.")
-			time.Sleep(p.SelfResetAfter)
-			gauge.Set(0)
-			logEntry.Info("Reset gauge.")
-		}()
+		// The deadline is relative to the event, so that a late delivered event does not stay set for too long.
+		resetAt = p.at().Add(p.SelfResetAfter)
+		p.logger().WithField("reset_at", resetAt).Debug("Delaying job reset.")
+	}
+	setGauge(vec, values, 1, resetAt)
+}
+
+// setGauge sets the gauge with the given label values and shares the change with other replicas. If resetAt is not
+// zero, the gauge is reset to 0 at the given time, or immediately if the time has already passed.
+func setGauge(vec *prometheus.GaugeVec, values []string, value float64, resetAt time.Time) {
+	gauge, err := vec.GetMetricWithLabelValues(values...)
+	if err != nil {
+		log.WithField("labels", values).WithError(err).Warn("Could not set gauge.")
+		return
+	}
+	if !resetAt.IsZero() {
+		if delay := time.Until(resetAt); delay > 0 {
+			scheduleReset(gauge, values, delay)
+		} else {
+			value = 0
+		}
+	}
+	gauge.Set(value)
+	trackGauge(vec, values, gauge)
+	state.Record(StateEntry{Gauge: gaugeName(vec), Labels: values, Value: value, ResetAt: resetAt})
+}
+
+// registerGauge initializes the gauge with the given label values to the given value, unless it exists or the shared
+// state already knows it.
+func registerGauge(vec *prometheus.GaugeVec, values []string, value float64) {
+	if gaugeValue(vec, values) == nil && !state.Known(vec, values) {
+		setGauge(vec, values, value, time.Time{})
+	}
+}
+
+// gaugeValue returns the value of the gauge with the given label values, or nil if it does not exist. Unlike
+// GetMetricWithLabelValues, it does not create the gauge.
+func gaugeValue(vec *prometheus.GaugeVec, values []string) *float64 {
+	gaugeSeriesMutex.Lock()
+	tracked, found := gaugeSeries[vec][seriesKey(values)]
+	gaugeSeriesMutex.Unlock()
+	if !found {
+		return nil
+	}
+	if gauge, err := vec.GetMetricWithLabelValues(values...); err != nil || gauge != tracked {
+		// The series has been deleted from the vector directly and has just been created again by the lookup.
+		vec.DeleteLabelValues(values...)
+		untrackGauge(vec, values)
+		return nil
+	}
+	var m dto.Metric
+	if err := tracked.Write(&m); err != nil {
+		return nil
+	}
+	value := m.GetGauge().GetValue()
+	return &value
+}
+
+// trackGauge remembers the gauge with the given label values for gaugeValue.
+func trackGauge(vec *prometheus.GaugeVec, values []string, gauge prometheus.Gauge) {
+	gaugeSeriesMutex.Lock()
+	defer gaugeSeriesMutex.Unlock()
+	series, found := gaugeSeries[vec]
+	if !found {
+		series = make(map[string]prometheus.Gauge)
+		gaugeSeries[vec] = series
+	}
+	series[seriesKey(values)] = gauge
+}
+
+// untrackGauge forgets the gauge with the given label values.
+func untrackGauge(vec *prometheus.GaugeVec, values []string) {
+	gaugeSeriesMutex.Lock()
+	defer gaugeSeriesMutex.Unlock()
+	delete(gaugeSeries[vec], seriesKey(values))
+}
+
+// seriesKey returns the key of the series with the given label values. The separator cannot occur in valid UTF-8.
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// deleteGauge deletes the gauge with the given label values and shares the change with other replicas. Returns true if
+// the gauge existed.
+func deleteGauge(vec *prometheus.GaugeVec, values []string) bool {
+	untrackGauge(vec, values)
+	if !vec.DeleteLabelValues(values...) {
+		return false
+	}
+	state.Record(StateEntry{Gauge: gaugeName(vec), Labels: values, Deleted: true})
+	return true
+}
+
+// scheduleReset resets the gauge to 0 after the given delay. A reset that has been scheduled previously for the same
+// gauge is replaced, so that repeated calls do not pile up timers.
+func scheduleReset(gauge prometheus.Gauge, values []string, delay time.Duration) {
+	resetTimersMutex.Lock()
+	defer resetTimersMutex.Unlock()
+	if timer, found := resetTimers[gauge]; found {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		gauge.Set(0)
+		log.WithField("labels", values).Info("Reset gauge.")
+		resetTimersMutex.Lock()
+		if resetTimers[gauge] == timer {
+			delete(resetTimers, gauge)
+		}
+		resetTimersMutex.Unlock()
+	})
+	resetTimers[gauge] = timer
+}
+
+// gaugeName returns the name of the phase that sets the given gauge vector, which identifies the vector in the shared
+// state.
+func gaugeName(vec *prometheus.GaugeVec) Phase {
+	switch vec {
+	case preSnapMetric:
+		return PhasePreSnap
+	case postSnapMetric:
+		return PhasePostSnap
+	case preSendMetric:
+		return PhasePreSend
+	case snapshotStateMetric:
+		return gaugeSnapshotState
+	case sendStateMetric:
+		return gaugeSendState
+	case jobPhaseMetric:
+		return gaugeJobPhase
+	case lastSnapshotMetric:
+		return gaugeLastSnapshot
+	case lastSendMetric:
+		return gaugeLastSend
+	default:
+		return PhasePostSend
+	}
+}
+
+// gaugeByName returns the gauge vector for the given name as returned by gaugeName, or nil if it is unknown.
+func gaugeByName(name Phase) *prometheus.GaugeVec {
+	switch name {
+	case PhasePreSnap:
+		return preSnapMetric
+	case PhasePostSnap:
+		return postSnapMetric
+	case PhasePreSend:
+		return preSendMetric
+	case PhasePostSend:
+		return postSendMetric
+	case gaugeSnapshotState:
+		return snapshotStateMetric
+	case gaugeSendState:
+		return sendStateMetric
+	case gaugeJobPhase:
+		return jobPhaseMetric
+	case gaugeLastSnapshot:
+		return lastSnapshotMetric
+	case gaugeLastSend:
+		return lastSendMetric
+	default:
+		return nil
 	}
 }
 
@@ -73,36 +503,454 @@ func (p *Job) ResetMetrics(tuples ...ResetMetricTuple) {
 		if !tuple.resetEnabled {
 			continue
 		}
-		if tuple.targetHost == "" {
-			tuple.vec.WithLabelValues(p.JobName).Set(0)
-		} else {
-			tuple.vec.WithLabelValues(p.JobName, tuple.targetHost).Set(0)
+		values := p.labelValues()
+		if tuple.targetHost != "" {
+			values = p.labelValues(tuple.targetHost)
+		}
+		// Send gauges cannot be reset without knowing the target host.
+		if _, err := tuple.vec.GetMetricWithLabelValues(values...); err == nil {
+			setGauge(tuple.vec, values, 0, time.Time{})
 		}
 	}
 }
 
-// RegisterMetric registers 4 new gauges with the given label (preSnap, postSnap, preSend, postSend) and initializes the
-// values with 0.
+// RegisterMetric registers the gauges of the job (preSnap, postSnap, snapshot state) and, if TargetHost is set, of the
+// target host (preSend, postSend, send state). The gauges are initialized according to the configured initial state:
+// With "unknown" they are 0, with "done" they are 1, as if a run had succeeded. The state and the phase always start
+// unknown, as they tell apart jobs that have not run yet. Existing series keep their values, so registering is
+// idempotent.
 func (p *Job) RegisterMetric() error {
-	logEvent := log.WithField("jobName", p.JobName)
-	preSnapMetric.WithLabelValues(p.JobName).Set(1)
-	postSnapMetric.WithLabelValues(p.JobName).Set(1)
+	logEvent := p.logger()
+	if err := registerDataset(*p); err != nil {
+		return err
+	}
+	value := 0.0
+	if jobsConfig.InitialState == InitialStateDone {
+		value = 1
+	}
+	registerGauge(preSnapMetric, p.labelValues(), value)
+	registerGauge(postSnapMetric, p.labelValues(), value)
+	registerGauge(snapshotStateMetric, p.labelValues(), JobStateUnknown)
+	p.registerPhase("", PhaseUnknown)
+	p.expectRun("", time.Now(), true)
 	if p.TargetHost != "" {
-		preSendMetric.WithLabelValues(p.JobName, p.TargetHost).Set(1)
-		postSendMetric.WithLabelValues(p.JobName, p.TargetHost).Set(1)
+		registerGauge(preSendMetric, p.labelValues(p.TargetHost), value)
+		registerGauge(postSendMetric, p.labelValues(p.TargetHost), value)
+		registerGauge(sendStateMetric, p.labelValues(p.TargetHost), JobStateUnknown)
+		p.registerPhase(p.TargetHost, PhaseUnknown)
+		p.expectRun(p.TargetHost, time.Now(), true)
 	}
 	logEvent.Debug("Registered metric.")
 	return nil
 }
 
-// UnregisterMetric deletes 4 gauges with the given label, if found.
-func (p *Job) UnregisterMetric() {
-	for _, vec := range metricVector {
-		if p.TargetHost == "" {
-			vec.DeleteLabelValues(p.JobName)
+// SetPhase sets the current phase of the job in the job phase stateset. The phases of a snapshot apply to the job
+// itself (empty target host) and to all its known target hosts, the phases of a send only to the target host.
+func (p *Job) SetPhase(phase Phase) {
+	targets := []string{p.TargetHost}
+	if started, _ := startedPhase(phase); started == PhasePreSnap {
+		targets = p.snapshotTargets()
+	}
+	for _, target := range targets {
+		p.setPhaseOf(target, phase)
+	}
+}
+
+// snapshotTargets returns the target hosts the phases of a snapshot apply to: the job itself (empty target host) and
+// all its known target hosts.
+func (p *Job) snapshotTargets() []string {
+	targets := []string{""}
+	if info, found := describeDataset(*p); found {
+		targets = append(targets, info.Targets...)
+	}
+	return targets
+}
+
+// SetFailed sets the state and the phase of the snapshot or send that has been started by the given phase to failed.
+func (p *Job) SetFailed(started Phase) {
+	targets := []string{p.TargetHost}
+	if started == PhasePreSnap {
+		setGauge(snapshotStateMetric, p.labelValues(), JobStateFailed, time.Time{})
+		targets = p.snapshotTargets()
+	} else {
+		setGauge(sendStateMetric, p.labelValues(p.TargetHost), JobStateFailed, time.Time{})
+	}
+	for _, target := range targets {
+		p.setPhaseOf(target, PhaseFailed)
+	}
+}
+
+// registerPhase initializes the job phase stateset of the target host with the given phase, unless it exists or the
+// shared state already knows it.
+func (p *Job) registerPhase(target string, phase Phase) {
+	values := p.labelValues(target, string(PhaseUnknown))
+	if gaugeValue(jobPhaseMetric, values) == nil && !state.Known(jobPhaseMetric, values) {
+		p.setPhaseOf(target, phase)
+	}
+}
+
+// setPhaseOf sets the series of the given phase to 1 and the series of all other phases to 0.
+func (p *Job) setPhaseOf(target string, phase Phase) {
+	for _, ph := range jobPhases {
+		value := 0.0
+		if ph == phase {
+			value = 1
+		}
+		setGauge(jobPhaseMetric, p.labelValues(target, string(ph)), value, time.Time{})
+	}
+}
+
+// SetState sets the snapshot or send state of the job according to the given phase: in progress after a pre command,
+// done after a post command.
+func (p *Job) SetState(phase Phase) {
+	started, finished := startedPhase(phase)
+	value := float64(JobStateInProgress)
+	if finished {
+		value = JobStateDone
+	}
+	if started == PhasePreSnap {
+		setGauge(snapshotStateMetric, p.labelValues(), value, time.Time{})
+	} else {
+		setGauge(sendStateMetric, p.labelValues(p.TargetHost), value, time.Time{})
+	}
+}
+
+// UnregisterMetric deletes all series of the job, including the series of all its target hosts. If TargetHost is set,
+// only the series of the target host are deleted and the job is kept. Returns the number of deleted series.
+func (p *Job) UnregisterMetric() int {
+	deleted := 0
+	targets := forgetDataset(*p)
+	if p.TargetHost != "" {
+		// The target host may not be known, e.g. if it has been set up by another replica.
+		deleted += p.deleteTargetSeries()
+	} else {
+		for _, target := range targets {
+			job := *p
+			job.TargetHost = target
+			deleted += job.deleteTargetSeries()
+		}
+		deleted += p.deleteJobSeries()
+	}
+	p.logger().WithField("series", deleted).Debug("Unregistered metric.")
+	return deleted
+}
+
+// ObserveRun counts the call of the given phase. If the phase finishes a snapshot or send, the time of success and the
+// duration since the matching pre command are observed as well. The pre command is matched by the RunID, or if none is
+// given, the run that started last is taken. The counter and duration carry the snapshot name, request and run ID as
+// exemplar.
+func (p *Job) ObserveRun(phase Phase) {
+	exemplar := p.exemplar()
+	incCounter(hookCallsMetric, p.labelValues(string(phase)), exemplar)
+
+	started, finished := startedPhase(phase)
+	key := runKey(*p, started)
+	now := p.at()
+	// The times of success are shared with other replicas, unlike the counters and durations.
+	if phase == PhasePostSnap {
+		setGauge(lastSnapshotMetric, p.labelValues(), float64(now.UnixNano())/1e9, time.Time{})
+	} else if phase == PhasePostSend {
+		setGauge(lastSendMetric, p.labelValues(p.TargetHost), float64(now.UnixNano())/1e9, time.Time{})
+	}
+	runStartsMutex.Lock()
+	expireRuns(time.Now())
+	if !finished {
+		runs := runStarts[key]
+		if len(runs) >= maxStartedRuns {
+			orphanRun(runs[0])
+			runs = append(runs[:0], runs[1:]...)
+		}
+		runStarts[key] = append(runs, startedRun{id: p.RunID, job: *p, phase: phase, started: now})
+		runStartsMutex.Unlock()
+		return
+	}
+	run, exists := takeRun(key, p.RunID)
+	runStartsMutex.Unlock()
+	if !exists {
+		if p.RunID != "" {
+			p.logger().WithField("phase", phase).Warn("No started run found for run ID.")
+		}
+		return
+	}
+
+	observer, err := snapshotDurationMetric.GetMetricWithLabelValues(p.labelValues()...)
+	if phase == PhasePostSend {
+		observer, err = sendDurationMetric.GetMetricWithLabelValues(p.labelValues(p.TargetHost)...)
+	}
+	if err != nil {
+		p.logger().WithError(err).Warn("Could not observe duration.")
+		return
+	}
+	observeWithExemplar(observer, now.Sub(run.started).Seconds(), exemplar)
+}
+
+// FailRun counts the call of the given post phase whose command has failed, and the failed run. The matching run is
+// finished without observing its duration or the time of success.
+func (p *Job) FailRun(phase Phase) {
+	incCounter(hookCallsMetric, p.labelValues(string(phase)), p.exemplar())
+	started, _ := startedPhase(phase)
+	runStartsMutex.Lock()
+	expireRuns(time.Now())
+	takeRun(runKey(*p, started), p.RunID)
+	runStartsMutex.Unlock()
+	incCounter(failedRunsMetric, p.labelValues(string(started)), nil)
+	p.logger().WithFields(log.Fields{"phase": started, "exit_code": p.ExitCode, "error": p.Error}).Warn("Run has failed.")
+}
+
+// isRunning returns true if a run of the given pre phase has been started and not finished yet. If RunID is set, the run
+// with this ID has to be running.
+func (p *Job) isRunning(started Phase) bool {
+	runStartsMutex.Lock()
+	defer runStartsMutex.Unlock()
+	for _, run := range runStarts[runKey(*p, started)] {
+		if p.RunID == "" || run.id == p.RunID {
+			return true
+		}
+	}
+	return false
+}
+
+// takeRun removes the run with the given ID from the started runs and returns it. If id is empty, the run that started
+// last is taken. runStartsMutex has to be held.
+func takeRun(key, id string) (startedRun, bool) {
+	runs := runStarts[key]
+	for i := len(runs) - 1; i >= 0; i-- {
+		if id != "" && runs[i].id != id {
+			continue
+		}
+		run := runs[i]
+		runs = append(runs[:i], runs[i+1:]...)
+		if len(runs) == 0 {
+			delete(runStarts, key)
+		} else {
+			runStarts[key] = runs
+		}
+		return run, true
+	}
+	return startedRun{}, false
+}
+
+// expireRuns removes the runs that have not been finished within the run timeout and counts them as orphaned.
+// runStartsMutex has to be held.
+func expireRuns(now time.Time) {
+	if hooksConfig.RunTimeout <= 0 {
+		return
+	}
+	deadline := now.Add(-hooksConfig.RunTimeout)
+	for key, runs := range runStarts {
+		active := runs[:0]
+		for _, run := range runs {
+			if run.started.After(deadline) {
+				active = append(active, run)
+				continue
+			}
+			orphanRun(run)
+		}
+		if len(active) == 0 {
+			delete(runStarts, key)
 		} else {
-			vec.DeleteLabelValues(p.JobName, p.TargetHost)
+			runStarts[key] = active
+		}
+	}
+}
+
+// orphanRun counts the given run as orphaned.
+func orphanRun(run startedRun) {
+	incCounter(orphanedRunsMetric, run.job.labelValues(string(run.phase)), nil)
+	run.job.logger().WithFields(log.Fields{"phase": run.phase, "started": run.started}).Warn("Run has not been finished.")
+}
+
+// RunExpiry expires the started runs that have not been finished within the run timeout until stop is closed, so that
+// orphaned runs are counted without further hook calls.
+func RunExpiry(timeout time.Duration, stop <-chan struct{}) {
+	interval := timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			runStartsMutex.Lock()
+			expireRuns(now)
+			runStartsMutex.Unlock()
 		}
 	}
-	log.WithField("job", p.JobName).Debug("Unregistered metric.")
+}
+
+// exemplar returns the exemplar labels of the job. Labels are omitted if they are empty or would exceed the maximum
+// length of an exemplar.
+func (p *Job) exemplar() prometheus.Labels {
+	labels := prometheus.Labels{}
+	length := 0
+	for _, pair := range [][2]string{{"request_id", p.requestID}, {"run_id", p.RunID}, {"snapshot", p.Snapshot}} {
+		runes := utf8.RuneCountInString(pair[0]) + utf8.RuneCountInString(pair[1])
+		if pair[1] == "" || !utf8.ValidString(pair[1]) || length+runes > maxExemplarRunes {
+			continue
+		}
+		labels[pair[0]] = pair[1]
+		length += runes
+	}
+	return labels
+}
+
+// incCounter increments the counter with the given label values, attaching the exemplar if given. Invalid label values
+// are logged instead of panicking while hookMutex is held.
+func incCounter(vec *prometheus.CounterVec, values []string, exemplar prometheus.Labels) {
+	counter, err := vec.GetMetricWithLabelValues(values...)
+	if err != nil {
+		log.WithField("labels", values).WithError(err).Warn("Could not increment counter.")
+		return
+	}
+	addWithExemplar(counter, exemplar)
+}
+
+// setTimestamp sets the gauge with the given label values to the given time in seconds since the Unix epoch. Invalid
+// label values are logged instead of panicking while hookMutex is held.
+func setTimestamp(vec *prometheus.GaugeVec, values []string, t time.Time) {
+	setSeries(vec, values, float64(t.UnixNano())/1e9)
+}
+
+// setSeries sets the gauge with the given label values, which is not shared with other replicas. Invalid label values
+// are logged instead of panicking while hookMutex is held.
+func setSeries(vec *prometheus.GaugeVec, values []string, value float64) {
+	gauge, err := vec.GetMetricWithLabelValues(values...)
+	if err != nil {
+		log.WithField("labels", values).WithError(err).Warn("Could not set gauge.")
+		return
+	}
+	gauge.Set(value)
+}
+
+func addWithExemplar(counter prometheus.Counter, exemplar prometheus.Labels) {
+	if adder, ok := counter.(prometheus.ExemplarAdder); ok && len(exemplar) > 0 {
+		adder.AddWithExemplar(1, exemplar)
+		return
+	}
+	counter.Inc()
+}
+
+func observeWithExemplar(observer prometheus.Observer, value float64, exemplar prometheus.Labels) {
+	if eo, ok := observer.(prometheus.ExemplarObserver); ok && len(exemplar) > 0 {
+		eo.ObserveWithExemplar(value, exemplar)
+		return
+	}
+	observer.Observe(value)
+}
+
+// parseLabelPairs parses a list of key=value pairs into labels.
+func parseLabelPairs(pairs []string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	for _, pair := range pairs {
+		arr := strings.SplitN(pair, "=", 2)
+		if len(arr) != 2 || arr[0] == "" {
+			return nil, fmt.Errorf("invalid label, expected key=value: %s", pair)
+		}
+		labels[arr[0]] = arr[1]
+	}
+	return labels, nil
+}
+
+// parseJobLabels parses a list of job:key=value entries. Returns the sorted, distinct label names and the label values
+// by job name.
+func parseJobLabels(entries []string) ([]string, map[string]map[string]string, error) {
+	values := make(map[string]map[string]string)
+	distinct := make(map[string]bool)
+	for _, entry := range entries {
+		i := strings.LastIndex(entry, ":")
+		if i <= 0 {
+			return nil, nil, fmt.Errorf("invalid job label, expected job:key=value: %s", entry)
+		}
+		labels, err := parseLabelPairs([]string{entry[i+1:]})
+		if err != nil {
+			return nil, nil, err
+		}
+		job := entry[:i]
+		if values[job] == nil {
+			values[job] = make(map[string]string)
+		}
+		for name, value := range labels {
+			values[job][name] = value
+			distinct[name] = true
+		}
+	}
+	names := make([]string, 0, len(distinct))
+	for name := range distinct {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, values, nil
+}
+
+// poolOf returns the pool of the given dataset path, e.g. "tank" for "tank/data/home".
+func poolOf(path string) string {
+	return strings.SplitN(path, "/", 2)[0]
+}
+
+// datasetOf returns the dataset path without the pool, e.g. "data/home" for "tank/data/home". Returns an empty string
+// for the root dataset of a pool.
+func datasetOf(path string) string {
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[i+1:]
+	}
+	return ""
+}
+
+// parentOf returns the path of the parent dataset, e.g. "tank/data" for "tank/data/home". Returns an empty string for
+// the root dataset of a pool.
+func parentOf(path string) string {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// startedPhase returns the phase that starts the run to which the given phase belongs, and whether the given phase
+// finishes the run.
+func startedPhase(phase Phase) (Phase, bool) {
+	switch phase {
+	case PhasePostSnap:
+		return PhasePreSnap, true
+	case PhasePostSend:
+		return PhasePreSend, true
+	default:
+		return phase, false
+	}
+}
+
+// acceptEvent records the time of the event of the given phase if it is not older than the latest event that changed the
+// same state. Returns the time of the latest event and whether the event has been accepted.
+func (p *Job) acceptEvent(phase Phase) (time.Time, bool) {
+	at := p.at()
+	key := p.eventKey(phase)
+	latestEventsMutex.Lock()
+	defer latestEventsMutex.Unlock()
+	if latest, found := latestEvents[key]; found && at.Before(latest) {
+		return latest, false
+	}
+	latestEvents[key] = at
+	return at, true
+}
+
+// eventKey returns a key that identifies the state changed by the hooks of the given phase. Snapshot hooks change the
+// state of the job, send hooks only that of their target host, so that the sends to different target hosts are ordered
+// independently of each other.
+func (p *Job) eventKey(phase Phase) string {
+	if phase == PhasePreSend || phase == PhasePostSend {
+		return p.jobKey() + "|" + p.TargetHost
+	}
+	return p.jobKey()
+}
+
+// jobKey returns a key that identifies the job regardless of its target host.
+func (p *Job) jobKey() string {
+	return p.SourceHost + "|" + p.JobName
+}
+
+// runKey returns a key that identifies a snapshot or send run of the given job.
+func runKey(job Job, phase Phase) string {
+	return string(phase) + "|" + job.SourceHost + "|" + job.JobName + "|" + job.TargetHost
 }
@@ -4,7 +4,11 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -94,3 +98,293 @@ func TestJobContext_ResetMetrics(t *testing.T) {
 		})
 	}
 }
+
+func TestSetupMetrics(t *testing.T) {
+	defer func() {
+		require.NoError(t, SetupMetrics(CreateDefaultConfig()))
+	}()
+	cfg := CreateDefaultConfig()
+	cfg.Metrics = MetricsMap{
+		Namespace:    "custom",
+		DatasetLabel: "dataset",
+		ConstLabels:  []string{"host=nas"},
+		JobLabels:    []string{"tank/data:environment=prod"},
+		LegacyGauges: true,
+	}
+	require.NoError(t, SetupMetrics(cfg))
+
+	j := Job{JobName: "tank/data", TargetHost: "remote"}
+	j.setMetric(preSnapMetric)
+	j.setMetricWithHost(preSendMetric)
+
+	expected := `
+# HELP custom_presend_command_started whether the command to run prior zfs send was started
+# TYPE custom_presend_command_started gauge
+custom_presend_command_started{dataset="tank/data",environment="prod",host="nas",target_host="remote"} 1
+# HELP custom_presnap_command_started whether the command to run prior zfs snapshot was started
+# TYPE custom_presnap_command_started gauge
+custom_presnap_command_started{dataset="tank/data",environment="prod",host="nas"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(gatherer, strings.NewReader(expected),
+		"custom_presnap_command_started", "custom_presend_command_started"))
+}
+
+func TestSetupMetrics_WhenInvalidConfig_ThenReturnError(t *testing.T) {
+	defer func() {
+		require.NoError(t, SetupMetrics(CreateDefaultConfig()))
+	}()
+	tests := map[string]MetricsMap{
+		"InvalidConstLabel": {Namespace: "znapzend", DatasetLabel: "job", ConstLabels: []string{"host"}},
+		"InvalidJobLabel":   {Namespace: "znapzend", DatasetLabel: "job", JobLabels: []string{"environment=prod"}},
+		"ClashingJobLabel":  {Namespace: "znapzend", DatasetLabel: "job", JobLabels: []string{"tank:target_host=x"}},
+		"InvalidLabelName":  {Namespace: "znapzend", DatasetLabel: "dataset-name"},
+		"InvalidNamespace":  {Namespace: "znap-zend", DatasetLabel: "job"},
+	}
+	for name, cfg := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := CreateDefaultConfig()
+			config.Metrics = cfg
+			assert.Error(t, SetupMetrics(config))
+		})
+	}
+}
+
+func TestJob_labelValues_WithPathLabels(t *testing.T) {
+	defer func() {
+		require.NoError(t, SetupMetrics(CreateDefaultConfig()))
+	}()
+	cfg := CreateDefaultConfig()
+	cfg.Metrics.PoolLabels = true
+	cfg.Metrics.ParentLabel = true
+	require.NoError(t, SetupMetrics(cfg))
+
+	tests := []struct {
+		name     string
+		path     string
+		expected []string
+	}{
+		{name: "GivenNestedDataset_ThenSplitPoolDatasetAndParent", path: "tank/data/home",
+			expected: []string{"tank/data/home", "tank", "data/home", "tank/data"}},
+		{name: "GivenChildOfPool_ThenParentIsPool", path: "tank/data",
+			expected: []string{"tank/data", "tank", "data", "tank"}},
+		{name: "GivenPool_ThenDatasetAndParentAreEmpty", path: "tank",
+			expected: []string{"tank", "tank", "", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := Job{JobName: tt.path}
+			assert.Equal(t, tt.expected, j.labelValues())
+			assert.NotPanics(t, func() { j.setMetric(preSnapMetric) })
+		})
+	}
+}
+
+func TestJob_ObserveRun_WithRunID(t *testing.T) {
+	defer func() {
+		for _, phase := range []Phase{PhasePreSend, PhasePostSend} {
+			hookCallsMetric.DeleteLabelValues("runs", string(phase))
+			orphanedRunsMetric.DeleteLabelValues("runs", string(phase))
+		}
+		sendDurationMetric.DeleteLabelValues("runs", "host")
+		lastSendMetric.DeleteLabelValues("runs", "host")
+	}()
+	start := time.Now().Add(-time.Minute)
+	job := func(runID string, offset time.Duration) Job {
+		return Job{JobName: "runs", TargetHost: "host", RunID: runID, eventTime: start.Add(offset)}
+	}
+	durations := func() []float64 {
+		m := &dto.Metric{}
+		require.NoError(t, sendDurationMetric.WithLabelValues("runs", "host").(prometheus.Histogram).Write(m))
+		return []float64{float64(m.Histogram.GetSampleCount()), m.Histogram.GetSampleSum()}
+	}
+
+	// Two overlapping sends finish in reverse order.
+	first, second := job("first", 0), job("second", 10*time.Second)
+	first.ObserveRun(PhasePreSend)
+	second.ObserveRun(PhasePreSend)
+	finishFirst := job("first", 30*time.Second)
+	finishFirst.ObserveRun(PhasePostSend)
+	assert.Equal(t, []float64{1, 30}, durations())
+	finishSecond := job("second", 15*time.Second)
+	finishSecond.ObserveRun(PhasePostSend)
+	assert.Equal(t, []float64{2, 35}, durations())
+
+	unknown := job("unknown", 20*time.Second)
+	unknown.ObserveRun(PhasePostSend)
+	assert.Equal(t, []float64{2, 35}, durations(), "unknown run IDs are not paired")
+
+	hooksConfig.RunTimeout = 30 * time.Second
+	defer func() {
+		hooksConfig = CreateDefaultConfig().Hooks
+	}()
+	orphan := job("orphan", 0)
+	orphan.ObserveRun(PhasePreSend)
+	next := job("next", 50*time.Second)
+	next.ObserveRun(PhasePreSend)
+	assert.EqualValues(t, 1, testutil.ToFloat64(orphanedRunsMetric.WithLabelValues("runs", string(PhasePreSend))))
+	runStartsMutex.Lock()
+	_, orphanExists := takeRun(runKey(next, PhasePreSend), "orphan")
+	_, nextExists := takeRun(runKey(next, PhasePreSend), "next")
+	runStartsMutex.Unlock()
+	assert.False(t, orphanExists)
+	assert.True(t, nextExists)
+}
+
+func TestJob_ObserveRun_WhenMaxStartedRunsExceeded_ThenOrphanFirstRun(t *testing.T) {
+	defer func() {
+		hookCallsMetric.DeleteLabelValues("capped", string(PhasePreSnap))
+		orphanedRunsMetric.DeleteLabelValues("capped", string(PhasePreSnap))
+		capped := Job{JobName: "capped"}
+		capped.forgetRuns()
+	}()
+	for i := 0; i <= maxStartedRuns; i++ {
+		j := Job{JobName: "capped", RunID: strconv.Itoa(i)}
+		j.ObserveRun(PhasePreSnap)
+	}
+
+	assert.EqualValues(t, 1, testutil.ToFloat64(orphanedRunsMetric.WithLabelValues("capped", string(PhasePreSnap))))
+	runStartsMutex.Lock()
+	defer runStartsMutex.Unlock()
+	key := runKey(Job{JobName: "capped"}, PhasePreSnap)
+	require.Len(t, runStarts[key], maxStartedRuns)
+	assert.Equal(t, "1", runStarts[key][0].id)
+}
+
+func TestRunExpiry(t *testing.T) {
+	hooksConfig.RunTimeout = time.Millisecond
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		hooksConfig = CreateDefaultConfig().Hooks
+		hookCallsMetric.DeleteLabelValues("expiry", string(PhasePreSnap))
+		orphanedRunsMetric.DeleteLabelValues("expiry", string(PhasePreSnap))
+	}()
+	j := Job{JobName: "expiry"}
+	j.ObserveRun(PhasePreSnap)
+
+	go RunExpiry(hooksConfig.RunTimeout, stop)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(orphanedRunsMetric.WithLabelValues("expiry", string(PhasePreSnap))) == 1
+	}, 3*time.Second, 50*time.Millisecond, "orphaned runs are counted without further hook calls")
+}
+
+func TestJob_RegisterMetric_InitialState(t *testing.T) {
+	tests := []struct {
+		name          string
+		initialState  string
+		expectedGauge float64
+	}{
+		{
+			name:          "GivenUnknownInitialState_ThenGaugesAreNotSet",
+			initialState:  InitialStateUnknown,
+			expectedGauge: 0,
+		},
+		{
+			name:          "GivenDoneInitialState_ThenGaugesAreSet",
+			initialState:  InitialStateDone,
+			expectedGauge: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobsConfig.InitialState = tt.initialState
+			j := Job{JobName: "initial", TargetHost: "host"}
+			defer func() {
+				jobsConfig = CreateDefaultConfig().Jobs
+				j.TargetHost = ""
+				j.UnregisterMetric()
+			}()
+			require.NoError(t, j.RegisterMetric())
+			assert.EqualValues(t, tt.expectedGauge, testutil.ToFloat64(postSnapMetric.WithLabelValues("initial")))
+			assert.EqualValues(t, tt.expectedGauge, testutil.ToFloat64(postSendMetric.WithLabelValues("initial", "host")))
+			assert.EqualValues(t, JobStateUnknown, testutil.ToFloat64(snapshotStateMetric.WithLabelValues("initial")))
+			assert.EqualValues(t, JobStateUnknown, testutil.ToFloat64(sendStateMetric.WithLabelValues("initial", "host")))
+			assert.EqualValues(t, 1, testutil.ToFloat64(jobPhaseMetric.WithLabelValues("initial", "", string(PhaseUnknown))))
+			assert.EqualValues(t, 1,
+				testutil.ToFloat64(jobPhaseMetric.WithLabelValues("initial", "host", string(PhaseUnknown))))
+		})
+	}
+}
+
+func TestJob_SetState(t *testing.T) {
+	j := Job{JobName: "stateful", TargetHost: "host"}
+	defer func() {
+		j.TargetHost = ""
+		j.UnregisterMetric()
+	}()
+	require.NoError(t, j.RegisterMetric())
+
+	j.SetState(PhasePreSnap)
+	assert.EqualValues(t, JobStateInProgress, testutil.ToFloat64(snapshotStateMetric.WithLabelValues("stateful")))
+	j.SetState(PhasePostSnap)
+	assert.EqualValues(t, JobStateDone, testutil.ToFloat64(snapshotStateMetric.WithLabelValues("stateful")))
+	assert.EqualValues(t, JobStateUnknown, testutil.ToFloat64(sendStateMetric.WithLabelValues("stateful", "host")),
+		"the snapshot does not change the send state")
+	j.SetState(PhasePreSend)
+	assert.EqualValues(t, JobStateInProgress, testutil.ToFloat64(sendStateMetric.WithLabelValues("stateful", "host")))
+}
+
+func TestJob_SetPhase(t *testing.T) {
+	defer func() {
+		require.NoError(t, SetupMetrics(CreateDefaultConfig()))
+		forgetDataset(Job{JobName: "tank/phase"})
+	}()
+	cfg := CreateDefaultConfig()
+	cfg.Metrics.LegacyGauges = false
+	require.NoError(t, SetupMetrics(cfg))
+
+	j := Job{JobName: "tank/phase", TargetHost: "remote"}
+	require.NoError(t, j.RegisterMetric())
+	j.SetPhase(PhasePreSnap)
+	j.TargetHost = "other"
+	require.NoError(t, rememberDataset(j))
+	j.SetPhase(PhasePreSend)
+
+	expected := `
+# HELP znapzend_job_phase current phase of the job, exactly one phase is 1
+# TYPE znapzend_job_phase gauge
+znapzend_job_phase{job="tank/phase",phase="failed",target_host=""} 0
+znapzend_job_phase{job="tank/phase",phase="failed",target_host="other"} 0
+znapzend_job_phase{job="tank/phase",phase="failed",target_host="remote"} 0
+znapzend_job_phase{job="tank/phase",phase="postsend",target_host=""} 0
+znapzend_job_phase{job="tank/phase",phase="postsend",target_host="other"} 0
+znapzend_job_phase{job="tank/phase",phase="postsend",target_host="remote"} 0
+znapzend_job_phase{job="tank/phase",phase="postsnap",target_host=""} 0
+znapzend_job_phase{job="tank/phase",phase="postsnap",target_host="other"} 0
+znapzend_job_phase{job="tank/phase",phase="postsnap",target_host="remote"} 0
+znapzend_job_phase{job="tank/phase",phase="presend",target_host=""} 0
+znapzend_job_phase{job="tank/phase",phase="presend",target_host="other"} 1
+znapzend_job_phase{job="tank/phase",phase="presend",target_host="remote"} 0
+znapzend_job_phase{job="tank/phase",phase="presnap",target_host=""} 1
+znapzend_job_phase{job="tank/phase",phase="presnap",target_host="other"} 0
+znapzend_job_phase{job="tank/phase",phase="presnap",target_host="remote"} 1
+znapzend_job_phase{job="tank/phase",phase="unknown",target_host=""} 0
+znapzend_job_phase{job="tank/phase",phase="unknown",target_host="other"} 0
+znapzend_job_phase{job="tank/phase",phase="unknown",target_host="remote"} 0
+`
+	assert.NoError(t, testutil.GatherAndCompare(gatherer, strings.NewReader(expected), "znapzend_job_phase"))
+	families, err := jobRegistry.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		assert.NotEqual(t, "znapzend_presnap_command_started", family.GetName(), "legacy gauges must not be exposed")
+	}
+}
+
+func TestJob_exemplar_WhenInvalidUTF8_ThenOmitLabel(t *testing.T) {
+	job := Job{requestID: "\xff", RunID: "run-1", Snapshot: "snap-1"}
+	assert.Equal(t, prometheus.Labels{"run_id": "run-1", "snapshot": "snap-1"}, job.exemplar())
+}
+
+func Test_gaugeValue(t *testing.T) {
+	values := []string{"gauge-value"}
+	assert.Nil(t, gaugeValue(preSnapMetric, values))
+
+	setGauge(preSnapMetric, values, 1, time.Time{})
+	value := gaugeValue(preSnapMetric, values)
+	require.NotNil(t, value)
+	assert.EqualValues(t, 1, *value)
+
+	require.True(t, preSnapMetric.DeleteLabelValues(values...))
+	assert.Nil(t, gaugeValue(preSnapMetric, values), "series deleted from the vector do not exist")
+	assert.False(t, preSnapMetric.DeleteLabelValues(values...), "the series must not be created")
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	// EventSendFailed is fired when a send is started again before the previous one has finished.
+	EventSendFailed = "send_failed"
+	// EventJobStuck is fired when a snapshot or send has not finished within the configured deadline.
+	EventJobStuck = "job_stuck"
+	// EventJobRecovered is fired when a stuck snapshot or send finally finishes.
+	EventJobRecovered = "job_recovered"
+	// EventRunFailed is fired when a post hook reports a non-zero exit code.
+	EventRunFailed = "run_failed"
+
+	defaultNotifyTemplate = `{"event":{{json .Event}},"job":{{json .Job}},"source_host":{{json .SourceHost}},"target_host":{{json .TargetHost}},` +
+		`"phase":{{json .Phase}},"run_id":{{json .RunID}},"message":{{json .Message}},"timestamp":{{json .Timestamp}}}`
+)
+
+var (
+	// notifier is nil unless webhooks are configured, in which case transitions are observed.
+	notifier *Notifier
+)
+
+type (
+	// Notifier POSTs webhook notifications on state transitions of the jobs.
+	Notifier struct {
+		urls     []string
+		events   map[string]bool
+		deadline time.Duration
+		retries  int
+		backoff  time.Duration
+		template *template.Template
+		client   *http.Client
+
+		mu      sync.Mutex
+		pending map[string]*pendingRun
+		wg      sync.WaitGroup
+	}
+	// Notification is the data that is passed to the payload template.
+	Notification struct {
+		Event      string
+		Job        string
+		SourceHost string
+		TargetHost string
+		Phase      Phase
+		RunID      string
+		ExitCode   int
+		Message    string
+		Timestamp  time.Time
+	}
+	pendingRun struct {
+		phase Phase
+		timer *time.Timer
+		stuck bool
+	}
+)
+
+// NewNotifier creates a new Notifier from the given config. Returns an error if the template cannot be parsed.
+func NewNotifier(cfg NotifyMap) (*Notifier, error) {
+	tpl, err := template.New("notification").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	events := make(map[string]bool)
+	for _, event := range cfg.Events {
+		events[strings.TrimSpace(event)] = true
+	}
+	return &Notifier{
+		urls:     cfg.URL,
+		events:   events,
+		deadline: cfg.Deadline,
+		retries:  cfg.Retries,
+		backoff:  cfg.Backoff,
+		template: tpl,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		pending:  make(map[string]*pendingRun),
+	}, nil
+}
+
+// Observe tracks the transition of the given job into the given phase and fires notifications accordingly.
+// Does nothing if the Notifier is nil.
+func (n *Notifier) Observe(job Job, phase Phase) {
+	if n == nil {
+		return
+	}
+	started, finished := startedPhase(phase)
+	key := runKey(job, started)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	run, exists := n.pending[key]
+	if exists {
+		run.stop()
+		delete(n.pending, key)
+	}
+	if finished {
+		if exists && run.stuck {
+			n.fire(EventJobRecovered, job, phase, fmt.Sprintf("%s finished after being stuck", phase))
+		}
+		return
+	}
+	if exists && !run.stuck && phase == PhasePreSend {
+		n.fire(EventSendFailed, job, phase, "send started again before the previous one has finished")
+	}
+	run = &pendingRun{phase: phase}
+	if n.deadline > 0 {
+		run.timer = time.AfterFunc(n.deadline, func() {
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.pending[key] != run {
+				return
+			}
+			if isSilenced(job, time.Now()) {
+				job.logger().WithField("phase", phase).Debug("Not notifying about stuck job in maintenance.")
+				return
+			}
+			run.stuck = true
+			n.fire(EventJobStuck, job, phase, fmt.Sprintf("%s did not finish within %s", phase, n.deadline))
+		})
+	}
+	n.pending[key] = run
+}
+
+// Fail fires a notification about the failed run of the given job, which is no longer waited for. Does nothing if the
+// Notifier is nil.
+func (n *Notifier) Fail(job Job, phase Phase) {
+	if n == nil {
+		return
+	}
+	started, _ := startedPhase(phase)
+	key := runKey(job, started)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if run, exists := n.pending[key]; exists {
+		run.stop()
+		delete(n.pending, key)
+	}
+	message := fmt.Sprintf("%s failed with exit code %d", started, job.ExitCode)
+	if job.Error != "" {
+		message += ": " + job.Error
+	}
+	n.fire(EventRunFailed, job, phase, message)
+}
+
+// Wait blocks until all notifications in flight have been delivered or given up.
+func (n *Notifier) Wait() {
+	if n == nil {
+		return
+	}
+	n.wg.Wait()
+}
+
+func (n *Notifier) fire(event string, job Job, phase Phase, message string) {
+	if !n.events[event] {
+		return
+	}
+	var buf bytes.Buffer
+	err := n.template.Execute(&buf, Notification{
+		Event:      event,
+		Job:        job.JobName,
+		SourceHost: job.SourceHost,
+		TargetHost: job.TargetHost,
+		Phase:      phase,
+		RunID:      job.RunID,
+		ExitCode:   job.ExitCode,
+		Message:    message,
+		Timestamp:  time.Now(),
+	})
+	logEvent := job.logger().WithField("event", event)
+	if err != nil {
+		logEvent.WithError(err).Error("Could not render notification.")
+		return
+	}
+	if !json.Valid(buf.Bytes()) {
+		logEvent.WithField("payload", buf.String()).Error("Notification template did not render valid JSON.")
+		return
+	}
+	for _, url := range n.urls {
+		n.wg.Add(1)
+		go func(url string, payload []byte) {
+			defer n.wg.Done()
+			if err := n.post(url, payload); err != nil {
+				logEvent.WithField("url", url).WithError(err).Warn("Could not deliver notification.")
+				return
+			}
+			logEvent.WithField("url", url).Debug("Delivered notification.")
+		}(url, buf.Bytes())
+	}
+}
+
+func (n *Notifier) post(url string, payload []byte) (err error) {
+	delay := n.backoff
+	for attempt := 0; attempt <= n.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var resp *http.Response
+		resp, err = n.client.Post(url, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return err
+		}
+	}
+	return err
+}
+
+func (r *pendingRun) stop() {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookRecorder struct {
+	mu       sync.Mutex
+	failures int
+	events   []Notification
+}
+
+func (w *webhookRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failures > 0 {
+		w.failures--
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	n := Notification{}
+	_ = json.Unmarshal(b, &struct {
+		Event      *string `json:"event"`
+		Job        *string `json:"job"`
+		TargetHost *string `json:"target_host"`
+	}{&n.Event, &n.Job, &n.TargetHost})
+	w.events = append(w.events, n)
+}
+
+func (w *webhookRecorder) Events() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var events []string
+	for _, n := range w.events {
+		events = append(events, n.Event)
+	}
+	return events
+}
+
+func newTestNotifier(t *testing.T, url string, deadline time.Duration) *Notifier {
+	cfg := CreateDefaultConfig().Notify
+	cfg.URL = []string{url}
+	cfg.Deadline = deadline
+	cfg.Backoff = time.Millisecond
+	n, err := NewNotifier(cfg)
+	require.NoError(t, err)
+	return n
+}
+
+func TestNotifier_Observe(t *testing.T) {
+	job := Job{JobName: "tank/data", TargetHost: "host"}
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		phases   []Phase
+		sleep    time.Duration
+		expected []string
+	}{
+		{
+			name:     "GivenPreSend_WhenPostSendFollows_ThenNotifyNothing",
+			phases:   []Phase{PhasePreSend, PhasePostSend},
+			expected: nil,
+		},
+		{
+			name:     "GivenPreSend_WhenPreSendAgain_ThenNotifySendFailed",
+			phases:   []Phase{PhasePreSend, PhasePreSend},
+			expected: []string{EventSendFailed},
+		},
+		{
+			name:     "GivenDeadline_WhenPreSnapTimesOut_ThenNotifyStuck",
+			deadline: 10 * time.Millisecond,
+			phases:   []Phase{PhasePreSnap},
+			sleep:    50 * time.Millisecond,
+			expected: []string{EventJobStuck},
+		},
+		{
+			name:     "GivenStuckSnapshot_WhenPostSnapFollows_ThenNotifyRecovered",
+			deadline: 10 * time.Millisecond,
+			phases:   []Phase{PhasePreSnap, PhasePostSnap},
+			sleep:    50 * time.Millisecond,
+			expected: []string{EventJobStuck, EventJobRecovered},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &webhookRecorder{}
+			server := httptest.NewServer(recorder)
+			defer server.Close()
+			n := newTestNotifier(t, server.URL, tt.deadline)
+
+			for i, phase := range tt.phases {
+				if i > 0 {
+					time.Sleep(tt.sleep)
+				}
+				n.Observe(job, phase)
+			}
+			time.Sleep(tt.sleep)
+			n.Wait()
+			assert.Equal(t, tt.expected, recorder.Events())
+		})
+	}
+}
+
+func TestNotifier_Fail(t *testing.T) {
+	recorder := &webhookRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	n := newTestNotifier(t, server.URL, 50*time.Millisecond)
+	job := Job{JobName: "tank/data", TargetHost: "host", ExitCode: 3}
+
+	n.Observe(job, PhasePreSend)
+	n.Fail(job, PhasePostSend)
+	time.Sleep(100 * time.Millisecond)
+	n.Wait()
+	assert.Equal(t, []string{EventRunFailed}, recorder.Events(), "a failed run is not reported as stuck")
+
+	var nilNotifier *Notifier
+	nilNotifier.Fail(job, PhasePostSend)
+}
+
+func TestNotifier_Retry(t *testing.T) {
+	recorder := &webhookRecorder{failures: 2}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	n := newTestNotifier(t, server.URL, 0)
+
+	n.Observe(Job{JobName: "tank"}, PhasePreSend)
+	n.Observe(Job{JobName: "tank"}, PhasePreSend)
+	n.Wait()
+
+	require.Len(t, recorder.events, 1)
+	assert.Equal(t, "tank", recorder.events[0].Job)
+}
+
+func TestNewNotifier_WhenInvalidTemplate_ThenReturnError(t *testing.T) {
+	cfg := CreateDefaultConfig().Notify
+	cfg.Template = "{{.Event"
+	_, err := NewNotifier(cfg)
+	assert.Error(t, err)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxCompletionEstimate is the maximum duration until the estimated completion of a send, to which the estimate of
+	// a send that barely progresses is clamped.
+	maxCompletionEstimate = 10 * 365 * 24 * time.Hour
+	// routeProgress is the first path segment of the progress reports, which counts as phase in the throttled requests.
+	routeProgress Phase = "progress"
+)
+
+var (
+	// sendProgress contains the first progress report of the running sends by runKey, from which the rate is estimated.
+	sendProgress      = make(map[string]progressSample)
+	sendProgressMutex sync.Mutex
+)
+
+type (
+	// progressSample is the number of bytes sent by a given time.
+	progressSample struct {
+		at    time.Time
+		bytes uint64
+	}
+)
+
+// handleProgress updates the progress of a running send to the target host. The send has to be started by a presend
+// hook and not be finished yet.
+func handleProgress(context *gin.Context) {
+	job := context.MustGet(parameterKey).(Job)
+	hookMutex.Lock()
+	defer hookMutex.Unlock()
+	if !isKnownTarget(job) || !job.isRunning(PhasePreSend) {
+		SetLogWithFields(context, log.WarnLevel, "Rejected progress of unknown send.", log.Fields{})
+		context.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("no send of job %s to %s is running", job.JobName, job.TargetHost),
+		})
+		return
+	}
+	ratio, eta := job.ObserveProgress()
+
+	SetLogLevel(context, log.DebugLevel)
+	response := gin.H{"status": "applied", "job": job.JobName, "bytes": job.Bytes}
+	if job.Total > 0 {
+		response["ratio"] = ratio
+	}
+	if !eta.IsZero() {
+		response["estimated_completion"] = eta
+	}
+	context.JSON(http.StatusOK, response)
+}
+
+// ObserveProgress sets the bytes sent to the target host and, if Total is given, the ratio and the estimated time of
+// completion, which is extrapolated from the rate since the first report of the send. Returns the ratio and the
+// estimated time of completion, which is zero if it is not known yet.
+func (p *Job) ObserveProgress() (float64, time.Time) {
+	values := p.labelValues(p.TargetHost)
+	now := p.at()
+	key := runKey(*p, PhasePreSend)
+	sendProgressMutex.Lock()
+	first, found := sendProgress[key]
+	// Fewer bytes than before mean that a new send has been started without presend hook.
+	if !found || p.Bytes < first.bytes || now.Before(first.at) {
+		first = progressSample{at: now, bytes: p.Bytes}
+		sendProgress[key] = first
+	}
+	sendProgressMutex.Unlock()
+
+	setSeries(sendProgressBytesMetric, values, float64(p.Bytes))
+	if p.Total == 0 {
+		return 0, time.Time{}
+	}
+	ratio := math.Min(float64(p.Bytes)/float64(p.Total), 1)
+	setSeries(sendProgressRatioMetric, values, ratio)
+
+	var eta time.Time
+	elapsed := now.Sub(first.at)
+	if p.Bytes > first.bytes && elapsed > 0 {
+		rate := float64(p.Bytes-first.bytes) / elapsed.Seconds()
+		remaining := math.Max(float64(p.Total)-float64(p.Bytes), 0)
+		eta = now.Add(time.Duration(math.Min(remaining/rate, maxCompletionEstimate.Seconds()) * float64(time.Second)))
+		setTimestamp(sendCompletionMetric, values, eta)
+	}
+	return ratio, eta
+}
+
+// resetProgress deletes the progress of the send to the target host. Returns the number of deleted series.
+func (p *Job) resetProgress() int {
+	sendProgressMutex.Lock()
+	delete(sendProgress, runKey(*p, PhasePreSend))
+	sendProgressMutex.Unlock()
+	return deleteSeries(p.labelValues(p.TargetHost), nil, sendProgressBytesMetric, sendProgressRatioMetric,
+		sendCompletionMetric)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJob_ObserveProgress(t *testing.T) {
+	job := Job{JobName: "tank/progress", TargetHost: "remote", Total: 1000}
+	defer job.resetProgress()
+	start := time.Now()
+
+	job.eventTime, job.Bytes = start, 100
+	ratio, eta := job.ObserveProgress()
+	assert.Equal(t, 0.1, ratio)
+	assert.True(t, eta.IsZero(), "the rate is not known after the first report")
+
+	job.eventTime, job.Bytes = start.Add(10*time.Second), 300
+	ratio, eta = job.ObserveProgress()
+	assert.Equal(t, 0.3, ratio)
+	// 200 bytes in 10s, so the remaining 700 bytes take 35s.
+	assert.Equal(t, start.Add(45*time.Second), eta)
+	values := []string{"tank/progress", "remote"}
+	assert.EqualValues(t, 300, testutil.ToFloat64(sendProgressBytesMetric.WithLabelValues(values...)))
+	assert.InDelta(t, float64(start.Add(45*time.Second).Unix()), testutil.ToFloat64(sendCompletionMetric.WithLabelValues(values...)), 1)
+
+	job.eventTime, job.Bytes = start.Add(20*time.Second), 50
+	ratio, eta = job.ObserveProgress()
+	assert.Equal(t, 0.05, ratio)
+	assert.True(t, eta.IsZero(), "fewer bytes start a new send")
+
+	job.eventTime, job.Bytes = start.Add(30*time.Second), 1200
+	ratio, _ = job.ObserveProgress()
+	assert.Equal(t, 1.0, ratio)
+
+	assert.Equal(t, 3, job.resetProgress())
+}
+
+func TestJob_ObserveProgress_WhenBarelyProgressing_ThenClampEstimate(t *testing.T) {
+	job := Job{JobName: "tank/stalled", TargetHost: "remote", Total: math.MaxUint64}
+	defer job.resetProgress()
+	start := time.Now()
+
+	job.eventTime, job.Bytes = start, 0
+	job.ObserveProgress()
+	job.eventTime, job.Bytes = start.Add(time.Hour), 1
+	_, eta := job.ObserveProgress()
+	assert.Equal(t, start.Add(time.Hour+maxCompletionEstimate), eta)
+}
+
+func TestProgressHandler(t *testing.T) {
+	defer func() {
+		job := Job{JobName: "tank/sending"}
+		job.UnregisterMetric()
+	}()
+	r := SetupRouter()
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", query, nil))
+		return w
+	}
+	values := []string{"tank/sending", "remote"}
+
+	assert.Equal(t, http.StatusNotFound, get("/progress/tank/sending?TargetHost=remote&Bytes=1").Code)
+	require.Equal(t, http.StatusOK, get("/presend/tank/sending?TargetHost=remote").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/progress/tank/sending?Bytes=1").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/progress/tank/sending?TargetHost=remote&Bytes=-1").Code)
+
+	w := get("/progress/tank/sending?TargetHost=remote&Bytes=256&Total=1024")
+	require.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Bytes uint64
+		Ratio float64
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.EqualValues(t, 256, response.Bytes)
+	assert.Equal(t, 0.25, response.Ratio)
+	assert.EqualValues(t, 0.25, testutil.ToFloat64(sendProgressRatioMetric.WithLabelValues(values...)))
+
+	require.Equal(t, http.StatusOK, get("/postsend/tank/sending?TargetHost=remote").Code)
+	assert.False(t, sendProgressRatioMetric.DeleteLabelValues(values...), "postsend resets the progress")
+	assert.False(t, sendProgressBytesMetric.DeleteLabelValues(values...))
+	assert.Equal(t, http.StatusNotFound, get("/progress/tank/sending?TargetHost=remote&Bytes=512").Code,
+		"progress after postsend is rejected")
+	assert.False(t, sendProgressBytesMetric.DeleteLabelValues(values...))
+}
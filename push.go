@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// PushModePushgateway pushes the metrics in the text exposition format to a Prometheus Pushgateway.
+	PushModePushgateway = "pushgateway"
+	// PushModeRemoteWrite pushes the metrics with the Prometheus remote write protocol.
+	PushModeRemoteWrite = "remote_write"
+)
+
+type (
+	// Pusher periodically pushes the metrics of a gatherer to a Pushgateway or a remote write endpoint.
+	Pusher struct {
+		cfg      PushMap
+		gatherer prometheus.Gatherer
+		client   *http.Client
+		grouping prometheus.Labels
+	}
+	// renamingGatherer renames labels of gathered metrics that would clash with the grouping labels.
+	renamingGatherer struct {
+		prometheus.Gatherer
+		reserved map[string]bool
+	}
+	authTransport struct {
+		cfg  PushMap
+		next http.RoundTripper
+	}
+	timeSeries struct {
+		labels []*dto.LabelPair
+		value  float64
+	}
+)
+
+// NewPusher creates a new Pusher from the given config. Returns an error if the config is invalid.
+func NewPusher(cfg PushMap, gatherer prometheus.Gatherer) (*Pusher, error) {
+	if cfg.Mode != PushModePushgateway && cfg.Mode != PushModeRemoteWrite {
+		return nil, fmt.Errorf("unknown push mode: %s", cfg.Mode)
+	}
+	if cfg.Interval <= 0 {
+		return nil, errors.New("push interval must be greater than 0")
+	}
+	grouping, err := parseLabelPairs(cfg.Grouping)
+	if err != nil {
+		return nil, err
+	}
+	reserved := map[string]bool{"job": true}
+	for name := range grouping {
+		reserved[name] = true
+	}
+	return &Pusher{
+		cfg:      cfg,
+		gatherer: renamingGatherer{Gatherer: gatherer, reserved: reserved},
+		grouping: grouping,
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: &authTransport{cfg: cfg, next: http.DefaultTransport},
+		},
+	}, nil
+}
+
+// Run pushes the metrics in the configured interval until the given channel is closed.
+func (p *Pusher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := p.Push(); err != nil {
+			log.WithField("url", p.cfg.URL).WithError(err).Warn("Could not push metrics.")
+		} else {
+			log.WithField("url", p.cfg.URL).Debug("Pushed metrics.")
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Push pushes the metrics once.
+func (p *Pusher) Push() error {
+	if p.cfg.Mode == PushModePushgateway {
+		return p.pushToGateway()
+	}
+	return p.remoteWrite()
+}
+
+func (p *Pusher) pushToGateway() error {
+	pusher := push.New(p.cfg.URL, p.cfg.Job).Client(p.client).Gatherer(p.gatherer)
+	for name, value := range p.grouping {
+		pusher.Grouping(name, value)
+	}
+	return pusher.Push()
+}
+
+func (p *Pusher) remoteWrite() error {
+	mfs, err := p.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	extra := []*dto.LabelPair{{Name: stringPtr("job"), Value: stringPtr(p.cfg.Job)}}
+	for name, value := range p.grouping {
+		extra = append(extra, &dto.LabelPair{Name: stringPtr(name), Value: stringPtr(value)})
+	}
+	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+	var buf []byte
+	for _, mf := range mfs {
+		for _, ts := range flattenMetricFamily(mf) {
+			buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+			buf = protowire.AppendBytes(buf, encodeTimeSeries(ts, extra, timestamp))
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.cfg.URL, bytes.NewReader(snappyEncode(buf)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code %d while pushing to %s: %s", resp.StatusCode, p.cfg.URL, body)
+	}
+	return nil
+}
+
+// Gather renames all reserved labels of the gathered metrics by prefixing them with "exported_", the same way
+// Prometheus does when scraping.
+func (g renamingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				if g.reserved[l.GetName()] {
+					l.Name = stringPtr("exported_" + l.GetName())
+				}
+			}
+		}
+	}
+	return mfs, err
+}
+
+// RoundTrip adds the configured credentials to the request.
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+t.cfg.BearerToken)
+	} else if t.cfg.Username != "" {
+		req.SetBasicAuth(t.cfg.Username, t.cfg.Password)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// flattenMetricFamily converts the given family into the individual series as they are stored by Prometheus.
+func flattenMetricFamily(mf *dto.MetricFamily) []timeSeries {
+	var result []timeSeries
+	name := mf.GetName()
+	add := func(name string, labels []*dto.LabelPair, value float64, extra ...*dto.LabelPair) {
+		all := []*dto.LabelPair{{Name: stringPtr("__name__"), Value: stringPtr(name)}}
+		all = append(append(all, labels...), extra...)
+		result = append(result, timeSeries{labels: all, value: value})
+	}
+	for _, m := range mf.Metric {
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			add(name, m.Label, m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			add(name, m.Label, m.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			add(name, m.Label, m.GetUntyped().GetValue())
+		case dto.MetricType_SUMMARY:
+			for _, q := range m.GetSummary().Quantile {
+				add(name, m.Label, q.GetValue(), labelPair("quantile", q.GetQuantile()))
+			}
+			add(name+"_sum", m.Label, m.GetSummary().GetSampleSum())
+			add(name+"_count", m.Label, float64(m.GetSummary().GetSampleCount()))
+		case dto.MetricType_HISTOGRAM:
+			for _, b := range m.GetHistogram().Bucket {
+				add(name+"_bucket", m.Label, float64(b.GetCumulativeCount()), labelPair("le", b.GetUpperBound()))
+			}
+			add(name+"_bucket", m.Label, float64(m.GetHistogram().GetSampleCount()), labelPair("le", math.Inf(1)))
+			add(name+"_sum", m.Label, m.GetHistogram().GetSampleSum())
+			add(name+"_count", m.Label, float64(m.GetHistogram().GetSampleCount()))
+		}
+	}
+	return result
+}
+
+// encodeTimeSeries encodes a prometheus.TimeSeries protobuf message with a single sample.
+func encodeTimeSeries(ts timeSeries, extra []*dto.LabelPair, timestamp int64) []byte {
+	labels := make(map[string]string)
+	for _, l := range extra {
+		labels[l.GetName()] = l.GetValue()
+	}
+	for _, l := range ts.labels {
+		labels[l.GetName()] = l.GetValue()
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf []byte
+	for _, name := range names {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, labels[name])
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, label)
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(ts.value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestamp))
+	buf = protowire.AppendTag(buf, 2, protowire.BytesType)
+	return protowire.AppendBytes(buf, sample)
+}
+
+// snappyEncode encodes the given data in the snappy block format. The data is stored as literals only, which is
+// valid snappy but without compression. This avoids an additional dependency for a few kilobytes per push.
+func snappyEncode(data []byte) []byte {
+	const maxChunk = 1 << 16
+	buf := protowire.AppendVarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxChunk {
+			n = maxChunk
+		}
+		// Tag 61 denotes a literal whose length-1 is stored in the following 2 bytes (little endian).
+		buf = append(buf, 61<<2, byte(n-1), byte((n-1)>>8))
+		buf = append(buf, data[:n]...)
+		data = data[n:]
+	}
+	return buf
+}
+
+func labelPair(name string, value float64) *dto.LabelPair {
+	return &dto.LabelPair{Name: stringPtr(name), Value: stringPtr(strconv.FormatFloat(value, 'g', -1, 64))}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type pushRecorder struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+}
+
+func (p *pushRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	p.method = r.Method
+	p.path = r.URL.Path
+	p.header = r.Header
+	p.body, _ = ioutil.ReadAll(r.Body)
+}
+
+func newTestRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_gauge", Help: "test"}, []string{"job"})
+	vec.WithLabelValues("tank/data").Set(1)
+	registry.MustRegister(vec)
+	return registry
+}
+
+// snappyDecode decodes snappy blocks that consist of literals only.
+func snappyDecode(t *testing.T, data []byte) []byte {
+	length, n := protowire.ConsumeVarint(data)
+	require.True(t, n > 0)
+	data = data[n:]
+	var result []byte
+	for len(data) > 0 {
+		require.EqualValues(t, 61<<2, data[0])
+		chunk := int(data[1]) + int(data[2])<<8 + 1
+		result = append(result, data[3:3+chunk]...)
+		data = data[3+chunk:]
+	}
+	require.EqualValues(t, length, len(result))
+	return result
+}
+
+func TestPusher_Push(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    PushMap
+		verify func(t *testing.T, r *pushRecorder)
+	}{
+		{
+			name: "GivenPushgatewayMode_WhenPushing_ThenPutTextFormatWithRenamedJobLabel",
+			cfg:  PushMap{Mode: PushModePushgateway, Job: "znapzend", Grouping: []string{"instance=nas"}},
+			verify: func(t *testing.T, r *pushRecorder) {
+				assert.Equal(t, http.MethodPut, r.method)
+				assert.Equal(t, "/metrics/job/znapzend/instance/nas", r.path)
+				assert.Contains(t, string(r.body), "exported_job")
+			},
+		},
+		{
+			name: "GivenRemoteWriteMode_WhenPushing_ThenPostSnappyProtobuf",
+			cfg:  PushMap{Mode: PushModeRemoteWrite, Job: "znapzend", BearerToken: "secret"},
+			verify: func(t *testing.T, r *pushRecorder) {
+				assert.Equal(t, http.MethodPost, r.method)
+				assert.Equal(t, "snappy", r.header.Get("Content-Encoding"))
+				assert.Equal(t, "Bearer secret", r.header.Get("Authorization"))
+				body := string(snappyDecode(t, r.body))
+				assert.Contains(t, body, "__name__")
+				assert.Contains(t, body, "test_gauge")
+				assert.Contains(t, body, "exported_job")
+				assert.Contains(t, body, "tank/data")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &pushRecorder{}
+			server := httptest.NewServer(recorder)
+			defer server.Close()
+			tt.cfg.URL = server.URL
+			tt.cfg.Interval = time.Minute
+
+			p, err := NewPusher(tt.cfg, newTestRegistry())
+			require.NoError(t, err)
+			require.NoError(t, p.Push())
+			tt.verify(t, recorder)
+		})
+	}
+}
+
+func TestNewPusher_WhenInvalidConfig_ThenReturnError(t *testing.T) {
+	tests := map[string]PushMap{
+		"UnknownMode":     {Mode: "unknown", Interval: time.Minute},
+		"MissingInterval": {Mode: PushModePushgateway},
+		"InvalidGrouping": {Mode: PushModePushgateway, Interval: time.Minute, Grouping: []string{"instance"}},
+	}
+	for name, cfg := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewPusher(cfg, newTestRegistry())
+			assert.Error(t, err)
+		})
+	}
+}
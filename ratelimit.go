@@ -0,0 +1,123 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// LimitClient is the rate limit of hook calls per client address.
+	LimitClient = "client"
+	// LimitJob is the rate limit of hook calls per job.
+	LimitJob = "job"
+
+	// maxBuckets is the maximum number of buckets per RateLimiter, the least recently used bucket is evicted beyond.
+	maxBuckets = 4096
+)
+
+var (
+	// clientLimiter and jobLimiter are nil unless rate limiting is enabled.
+	clientLimiter *RateLimiter
+	jobLimiter    *RateLimiter
+)
+
+type (
+	// RateLimiter limits the rate of requests by key with a token bucket per key. The number of buckets is limited to
+	// maxBuckets by evicting the least recently used bucket.
+	RateLimiter struct {
+		rate    float64
+		burst   float64
+		mu      sync.Mutex
+		buckets map[string]*list.Element
+		// recent contains the buckets, the most recently used first.
+		recent *list.List
+	}
+	tokenBucket struct {
+		key     string
+		tokens  float64
+		updated time.Time
+	}
+)
+
+// NewRateLimiter creates a new RateLimiter that allows rate requests per second and key, with bursts of up to burst
+// requests. Returns nil if rate is not greater than 0.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*list.Element), recent: list.New()}
+}
+
+// Allow takes a token from the bucket of the given key. If the bucket is empty, it returns false and the duration
+// after which the next token is available. Always returns true if the RateLimiter is nil.
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	element, found := l.buckets[key]
+	if found {
+		l.recent.MoveToFront(element)
+	} else {
+		if l.recent.Len() >= maxBuckets {
+			oldest := l.recent.Back()
+			l.recent.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).key)
+		}
+		element = l.recent.PushFront(&tokenBucket{key: key, tokens: l.burst, updated: now})
+		l.buckets[key] = element
+	}
+	b := element.Value.(*tokenBucket)
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// RateLimitHandle returns a Gin handler that limits the rate of hook calls and progress reports per client address and
+// per job. Progress reports are counted in buckets of their own, so that frequent reports do not throttle the hooks.
+// Requests exceeding a limit are rejected with 429 and a Retry-After header. Does nothing if no limit is configured.
+func RateLimitHandle() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		phase := Phase(strings.SplitN(strings.TrimPrefix(c.Request.URL.Path, "/"), "/", 2)[0])
+		prefix := ""
+		if phase == routeProgress {
+			prefix = string(routeProgress) + "|"
+		} else if !validPhase(phase) {
+			return
+		}
+		now := time.Now()
+		limit := LimitClient
+		allowed, retryAfter := clientLimiter.Allow(prefix+clientAddress(c), now)
+		if value, exists := c.Get(parameterKey); allowed && exists {
+			job := value.(Job)
+			limit = LimitJob
+			allowed, retryAfter = jobLimiter.Allow(prefix+job.jobKey(), now)
+		}
+		if allowed {
+			return
+		}
+		throttledRequestsMetric.WithLabelValues(string(phase), limit).Inc()
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(seconds))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"error": fmt.Sprintf("too many requests per %s, retry after %ds", limit, seconds),
+		})
+		SetLogWithFields(c, log.WarnLevel, "Throttled request.", log.Fields{"limit": limit})
+	}
+}
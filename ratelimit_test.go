@@ -0,0 +1,125 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name          string
+		requests      []time.Duration
+		expectAllowed []bool
+	}{
+		{
+			name:          "GivenBurst_WhenExceeded_ThenThrottle",
+			requests:      []time.Duration{0, 0, 0},
+			expectAllowed: []bool{true, true, false},
+		},
+		{
+			name:          "GivenEmptyBucket_WhenRefilled_ThenAllow",
+			requests:      []time.Duration{0, 0, 0, time.Second},
+			expectAllowed: []bool{true, true, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewRateLimiter(1, 2)
+			for i, offset := range tt.requests {
+				allowed, retryAfter := l.Allow("key", now.Add(offset))
+				assert.Equal(t, tt.expectAllowed[i], allowed, "request %d", i)
+				if !allowed {
+					assert.Equal(t, time.Second, retryAfter)
+				}
+			}
+			allowed, _ := l.Allow("other", now)
+			assert.True(t, allowed, "buckets are separated by key")
+		})
+	}
+}
+
+func TestRateLimiter_Nil(t *testing.T) {
+	assert.Nil(t, NewRateLimiter(0, 10))
+	allowed, _ := (*RateLimiter)(nil).Allow("key", time.Now())
+	assert.True(t, allowed)
+}
+
+func TestRateLimitHandle(t *testing.T) {
+	jobLimiter = NewRateLimiter(0.001, 1)
+	defer func() {
+		jobLimiter = nil
+		for _, vec := range metricVector {
+			vec.DeleteLabelValues("throttled")
+			vec.DeleteLabelValues("other")
+		}
+	}()
+	r := SetupRouter()
+	throttled := testutil.ToFloat64(throttledRequestsMetric.WithLabelValues(string(PhasePostSnap), LimitJob))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/postsnap/throttled", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/postsnap/throttled", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1000", w.Header().Get("Retry-After"))
+	assert.EqualValues(t, throttled+1, testutil.ToFloat64(throttledRequestsMetric.WithLabelValues(string(PhasePostSnap), LimitJob)))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/postsnap/other", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "other jobs are not throttled")
+
+	progress := testutil.ToFloat64(throttledRequestsMetric.WithLabelValues(string(routeProgress), LimitJob))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/progress/throttled?TargetHost=host&Bytes=1", nil))
+	assert.NotEqual(t, http.StatusTooManyRequests, w.Code, "progress reports do not share the buckets of the hooks")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/progress/throttled?TargetHost=host&Bytes=2", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.EqualValues(t, progress+1, testutil.ToFloat64(throttledRequestsMetric.WithLabelValues(string(routeProgress), LimitJob)))
+}
+
+func TestRateLimiter_Allow_WhenMaxBucketsExceeded_ThenEvictLeastRecentlyUsed(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(0.001, 1)
+	l.Allow("recent", now)
+	l.Allow("oldest", now)
+	for i := 0; i < maxBuckets-2; i++ {
+		l.Allow(strconv.Itoa(i), now)
+	}
+	l.Allow("recent", now)
+	l.Allow("new", now)
+
+	assert.Len(t, l.buckets, maxBuckets)
+	assert.Equal(t, maxBuckets, l.recent.Len())
+	allowed, _ := l.Allow("recent", now)
+	assert.False(t, allowed, "recently used buckets are kept")
+	allowed, _ = l.Allow("oldest", now)
+	assert.True(t, allowed, "the least recently used bucket is evicted")
+}
+
+func TestRateLimitHandle_WhenForwardedFor_ThenLimitByConnectionAddress(t *testing.T) {
+	clientLimiter = NewRateLimiter(0.001, 1)
+	defer func() {
+		clientLimiter = nil
+		for _, vec := range metricVector {
+			vec.DeleteLabelValues("spoofed")
+		}
+	}()
+	r := SetupRouter()
+
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/postsnap/spoofed", nil)
+		req.Header.Set("X-Forwarded-For", "10.0.0."+strconv.Itoa(i))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, expected, w.Code, "request %d", i)
+	}
+}
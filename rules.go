@@ -0,0 +1,526 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RulesOutputRules prints the Prometheus recording and alerting rules.
+	RulesOutputRules = "rules"
+	// RulesOutputDashboard prints the Grafana dashboard.
+	RulesOutputDashboard = "dashboard"
+	// RulesOutputTests prints the promtool unit tests of the alerting rules.
+	RulesOutputTests = "tests"
+)
+
+type (
+	// RulesConfig parameterizes the generated alerting rules, dashboard and rule tests.
+	RulesConfig struct {
+		Namespace    string
+		DatasetLabel string
+		// TenantLabel is the label of the source host in multi-tenant mode, empty otherwise.
+		TenantLabel  string
+		ScrapeJob    string
+		Deadline     time.Duration
+		JobDeadlines []jobDeadline
+		StuckAfter   time.Duration
+		RulesFile    string
+	}
+	jobDeadline struct {
+		job      string
+		deadline time.Duration
+	}
+	// RuleFile is a Prometheus rule file.
+	RuleFile struct {
+		Groups []RuleGroup `yaml:"groups"`
+	}
+	// RuleGroup is a group of rules within a RuleFile.
+	RuleGroup struct {
+		Name  string `yaml:"name"`
+		Rules []Rule `yaml:"rules"`
+	}
+	// Rule is a recording or alerting rule.
+	Rule struct {
+		Record      string            `yaml:"record,omitempty"`
+		Alert       string            `yaml:"alert,omitempty"`
+		Expr        string            `yaml:"expr"`
+		For         string            `yaml:"for,omitempty"`
+		Labels      map[string]string `yaml:"labels,omitempty"`
+		Annotations map[string]string `yaml:"annotations,omitempty"`
+	}
+	// RuleTestFile is a unit test file for the rules that can be run with "promtool test rules".
+	RuleTestFile struct {
+		RuleFiles          []string   `yaml:"rule_files"`
+		EvaluationInterval string     `yaml:"evaluation_interval"`
+		Tests              []RuleTest `yaml:"tests"`
+	}
+	// RuleTest is a single test case of a RuleTestFile.
+	RuleTest struct {
+		Name          string          `yaml:"name"`
+		Interval      string          `yaml:"interval"`
+		InputSeries   []InputSeries   `yaml:"input_series"`
+		AlertRuleTest []AlertRuleTest `yaml:"alert_rule_test"`
+	}
+	// InputSeries is a series given to a RuleTest in the expanding notation of promtool, e.g. "0x10".
+	InputSeries struct {
+		Series string `yaml:"series"`
+		Values string `yaml:"values"`
+	}
+	// AlertRuleTest lists the alerts that are expected to fire at the given time.
+	AlertRuleTest struct {
+		EvalTime  string          `yaml:"eval_time"`
+		Alertname string          `yaml:"alertname"`
+		ExpAlerts []ExpectedAlert `yaml:"exp_alerts"`
+	}
+	// ExpectedAlert is an alert that is expected to fire, with its labels and expanded annotations.
+	ExpectedAlert struct {
+		ExpLabels      map[string]string `yaml:"exp_labels"`
+		ExpAnnotations map[string]string `yaml:"exp_annotations"`
+	}
+)
+
+var (
+	labelTemplatePattern = regexp.MustCompile(`{{ \$labels\.([a-zA-Z_][a-zA-Z0-9_]*) }}`)
+)
+
+// runRulesCommand implements the "rules" subcommand, which prints alerting rules, a Grafana dashboard or rule tests.
+func runRulesCommand(args []string) int {
+	defaults := CreateDefaultConfig()
+	flags := flag.NewFlagSet("rules", flag.ContinueOnError)
+	output := flags.String("output", RulesOutputRules, "What to print, either 'rules' (Prometheus rule file), 'dashboard' (Grafana dashboard JSON) or 'tests' (promtool rule tests)")
+	namespace := flags.String("metrics.namespace", defaults.Metrics.Namespace, "Namespace (prefix) of all metric names, as configured in the exporter")
+	datasetLabel := flags.String("metrics.datasetLabel", "exported_job", "Name of the label that holds the dataset as stored by Prometheus, e.g. 'job' if the scrape config sets honor_labels")
+	tenantLabel := flags.String("tenants.label", "", "Name of the label that holds the source host, if the exporter runs in multi-tenant mode")
+	scrapeJob := flags.String("scrape.job", "znapzend-exporter", "Value of the job label of the scrape target, used to alert on missing scrapes")
+	deadline := flags.Duration("deadline", 26*time.Hour, "Maximum age of the last successful snapshot and send")
+	jobDeadlines := flags.StringSlice("jobDeadline", []string{}, "Deadline of a single job in the form job=duration, e.g. tank/archive=192h. Can be specified multiple times")
+	stuckAfter := flags.Duration("stuckAfter", 6*time.Hour, "Duration after which a snapshot or send that has not finished is considered stuck")
+	rulesFile := flags.String("rules.file", "znapzend-rules.yml", "Path of the rule file referenced by the rule tests")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s rules [flags] > file\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	cfg := RulesConfig{
+		Namespace:    *namespace,
+		DatasetLabel: *datasetLabel,
+		TenantLabel:  *tenantLabel,
+		ScrapeJob:    *scrapeJob,
+		Deadline:     *deadline,
+		StuckAfter:   *stuckAfter,
+		RulesFile:    *rulesFile,
+	}
+	for _, pair := range *jobDeadlines {
+		arr := strings.SplitN(pair, "=", 2)
+		var d time.Duration
+		var err error
+		if len(arr) == 2 {
+			d, err = time.ParseDuration(arr[1])
+		}
+		if len(arr) != 2 || arr[0] == "" || err != nil || d <= 0 {
+			log.WithField("jobDeadline", pair).Error("Invalid job deadline, expected job=duration.")
+			return 2
+		}
+		cfg.JobDeadlines = append(cfg.JobDeadlines, jobDeadline{job: arr[0], deadline: d})
+	}
+
+	var b []byte
+	var err error
+	switch *output {
+	case RulesOutputRules:
+		b, err = yaml.Marshal(cfg.Rules())
+	case RulesOutputDashboard:
+		b, err = json.MarshalIndent(cfg.Dashboard(), "", "  ")
+		b = append(b, '\n')
+	case RulesOutputTests:
+		b, err = yaml.Marshal(cfg.Tests())
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		log.WithError(err).Error("Could not render output.")
+		return 1
+	}
+	if _, err := os.Stdout.Write(b); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// Rules returns the recording and alerting rules.
+func (c RulesConfig) Rules() RuleFile {
+	ns := c.Namespace
+	alerts := []Rule{{
+		Alert:  "ZnapzendExporterDown",
+		Expr:   fmt.Sprintf(`absent(up{job=%s} == 1)`, strconv.Quote(c.ScrapeJob)),
+		For:    "5m",
+		Labels: map[string]string{"severity": "critical"},
+		Annotations: map[string]string{
+			"summary": "The znapzend exporter has not been scraped successfully for 5 minutes.",
+		},
+	}}
+	alerts = append(alerts, c.staleRules("ZnapzendSnapshotStale", ns+":last_snapshot_age_seconds",
+		"The last snapshot of {{ $labels."+c.DatasetLabel+" }} is older than %s.")...)
+	alerts = append(alerts, c.staleRules("ZnapzendSendStale", ns+":last_send_age_seconds",
+		"The last send of {{ $labels."+c.DatasetLabel+" }} to {{ $labels.target_host }} is older than %s.")...)
+	alerts = append(alerts, Rule{
+		Alert: "ZnapzendPhaseStuck",
+		Expr: c.unlessSilenced(fmt.Sprintf(`min_over_time(%s_job_phase{phase=~"presnap|presend"}[%s]) == 1`,
+			ns, promDuration(c.StuckAfter))),
+		Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{
+			"summary": "The {{ $labels.phase }} of {{ $labels." + c.DatasetLabel + " }} has not finished within " +
+				promDuration(c.StuckAfter) + ".",
+		},
+	}, Rule{
+		Alert:  "ZnapzendRunOrphaned",
+		Expr:   fmt.Sprintf(`increase(%s_orphaned_runs_total[1h]) > 0`, ns),
+		Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{
+			"summary": "A {{ $labels.phase }} of {{ $labels." + c.DatasetLabel + " }} has been started but never finished.",
+		},
+	}, Rule{
+		Alert:  "ZnapzendRunFailed",
+		Expr:   fmt.Sprintf(`increase(%s_failed_runs_total[1h]) > 0`, ns),
+		Labels: map[string]string{"severity": "critical"},
+		Annotations: map[string]string{
+			"summary": "A {{ $labels.phase }} of {{ $labels." + c.DatasetLabel + " }} has failed.",
+		},
+	}, Rule{
+		Alert:  "ZnapzendRunMissed",
+		Expr:   c.unlessSilenced(fmt.Sprintf(`increase(%s_job_missed_runs_total[1h]) > 0`, ns)),
+		Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{
+			"summary": "A scheduled run of {{ $labels." + c.DatasetLabel + " }} has been missed.",
+		},
+	}, Rule{
+		Alert:  "ZnapzendHooksRejected",
+		Expr:   fmt.Sprintf(`increase(%s_hook_calls_rejected_total[15m]) > 0`, ns),
+		Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{
+			"summary": "Calls to {{ $labels.phase }} have been rejected ({{ $labels.reason }}), check the znapzend hooks.",
+		},
+	})
+	return RuleFile{Groups: []RuleGroup{
+		{Name: ns + ".rules", Rules: []Rule{
+			{Record: ns + ":last_snapshot_age_seconds", Expr: fmt.Sprintf("time() - %s_last_snapshot_success_timestamp_seconds", ns)},
+			{Record: ns + ":last_send_age_seconds", Expr: fmt.Sprintf("time() - %s_last_send_success_timestamp_seconds", ns)},
+		}},
+		{Name: ns + ".alerts", Rules: alerts},
+	}}
+}
+
+// staleRules returns an alert for each job with its own deadline and one for all other jobs with the default deadline.
+func (c RulesConfig) staleRules(name, metric, summary string) []Rule {
+	rule := func(selector string, deadline time.Duration) Rule {
+		return Rule{
+			Alert:       name,
+			Expr:        c.unlessSilenced(fmt.Sprintf("%s%s > %d", metric, selector, int64(deadline.Seconds()))),
+			Labels:      map[string]string{"severity": "critical"},
+			Annotations: map[string]string{"summary": fmt.Sprintf(summary, promDuration(deadline))},
+		}
+	}
+	var rules []Rule
+	var jobs []string
+	for _, jd := range c.JobDeadlines {
+		rules = append(rules, rule(fmt.Sprintf("{%s=%s}", c.DatasetLabel, strconv.Quote(jd.job)), jd.deadline))
+		jobs = append(jobs, regexp.QuoteMeta(jd.job))
+	}
+	selector := ""
+	if len(jobs) > 0 {
+		selector = fmt.Sprintf("{%s!~%s}", c.DatasetLabel, strconv.Quote(strings.Join(jobs, "|")))
+	}
+	return append(rules, rule(selector, c.Deadline))
+}
+
+// unlessSilenced excludes the jobs in maintenance from the result of the expression. Jobs are matched by dataset, by the
+// job label of the scrape target unless it holds the dataset, and by source host in multi-tenant mode, so that a
+// silence does not apply to the datasets of the same name of other exporters or source hosts.
+func (c RulesConfig) unlessSilenced(expr string) string {
+	labels := []string{c.DatasetLabel}
+	if c.DatasetLabel != "job" {
+		labels = append(labels, "job")
+	}
+	if c.TenantLabel != "" {
+		labels = append(labels, c.TenantLabel)
+	}
+	return fmt.Sprintf("%s unless on(%s) %s_job_silenced == 1", expr, strings.Join(labels, ", "), c.Namespace)
+}
+
+// Dashboard returns a Grafana dashboard showing the phase, the age of the last success, the durations and the progress
+// of the sends.
+func (c RulesConfig) Dashboard() map[string]interface{} {
+	ns, ds := c.Namespace, c.DatasetLabel
+	type target struct {
+		expr, legend string
+		instant      bool
+	}
+	id := 0
+	panel := func(title, kind, unit string, x, y, w int, targets ...target) map[string]interface{} {
+		id++
+		var ts []map[string]interface{}
+		for i, t := range targets {
+			ts = append(ts, map[string]interface{}{
+				"expr":         t.expr,
+				"legendFormat": t.legend,
+				"instant":      t.instant,
+				"refId":        string(rune('A' + i)),
+			})
+		}
+		return map[string]interface{}{
+			"id":         id,
+			"title":      title,
+			"type":       kind,
+			"datasource": "$datasource",
+			"gridPos":    map[string]int{"x": x, "y": y, "w": w, "h": 8},
+			"targets":    ts,
+			"fieldConfig": map[string]interface{}{
+				"defaults":  map[string]interface{}{"unit": unit},
+				"overrides": []interface{}{},
+			},
+		}
+	}
+	deadlineThresholds := map[string]interface{}{
+		"mode": "absolute",
+		"steps": []map[string]interface{}{
+			{"color": "green", "value": nil},
+			{"color": "red", "value": int64(c.Deadline.Seconds())},
+		},
+	}
+	panels := []map[string]interface{}{
+		panel("Current phase", "table", "none", 0, 0, 24,
+			target{expr: fmt.Sprintf("%s_job_phase == 1", ns), instant: true}),
+		panel("Time since last snapshot", "timeseries", "s", 0, 8, 12,
+			target{expr: fmt.Sprintf("time() - %s_last_snapshot_success_timestamp_seconds", ns), legend: "{{" + ds + "}}"}),
+		panel("Time since last send", "timeseries", "s", 12, 8, 12,
+			target{expr: fmt.Sprintf("time() - %s_last_send_success_timestamp_seconds", ns), legend: "{{" + ds + "}} → {{target_host}}"}),
+		panel("Snapshot duration (p95)", "timeseries", "s", 0, 16, 12, target{
+			expr:   fmt.Sprintf("histogram_quantile(0.95, sum by (le, %s) (rate(%s_snapshot_duration_seconds_bucket[1d])))", ds, ns),
+			legend: "{{" + ds + "}}",
+		}),
+		panel("Send duration (p95)", "timeseries", "s", 12, 16, 12, target{
+			expr:   fmt.Sprintf("histogram_quantile(0.95, sum by (le, %s, target_host) (rate(%s_send_duration_seconds_bucket[1d])))", ds, ns),
+			legend: "{{" + ds + "}} → {{target_host}}",
+		}),
+		panel("Hook calls", "timeseries", "ops", 0, 24, 12, target{
+			expr:   fmt.Sprintf("sum by (phase) (rate(%s_hook_calls_total[5m]))", ns),
+			legend: "{{phase}}",
+		}),
+		panel("Rejected hooks and orphaned runs", "timeseries", "short", 12, 24, 12, target{
+			expr:   fmt.Sprintf("sum by (reason) (increase(%s_hook_calls_rejected_total[1h]))", ns),
+			legend: "rejected: {{reason}}",
+		}, target{
+			expr:   fmt.Sprintf("sum by (phase) (increase(%s_orphaned_runs_total[1h]))", ns),
+			legend: "orphaned: {{phase}}",
+		}),
+		panel("Send progress", "bargauge", "percentunit", 0, 32, 24, target{
+			expr:    fmt.Sprintf("%s_send_progress_ratio", ns),
+			legend:  "{{" + ds + "}} → {{target_host}}",
+			instant: true,
+		}),
+	}
+	// The age panels show the default deadline as a threshold line.
+	for _, p := range panels[1:3] {
+		defaults := p["fieldConfig"].(map[string]interface{})["defaults"].(map[string]interface{})
+		defaults["thresholds"] = deadlineThresholds
+		defaults["custom"] = map[string]interface{}{"thresholdsStyle": map[string]string{"mode": "line"}}
+	}
+	return map[string]interface{}{
+		"title":         "Znapzend",
+		"uid":           ns + "-exporter",
+		"tags":          []string{"znapzend", "zfs"},
+		"timezone":      "browser",
+		"schemaVersion": 27,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-7d", "to": "now"},
+		"templating": map[string]interface{}{
+			"list": []map[string]interface{}{{
+				"name":  "datasource",
+				"label": "Data source",
+				"type":  "datasource",
+				"query": "prometheus",
+			}},
+		},
+		"panels": panels,
+	}
+}
+
+// Tests returns promtool rule tests that verify the alerts of Rules with the configured deadlines.
+func (c RulesConfig) Tests() RuleTestFile {
+	ns, ds := c.Namespace, c.DatasetLabel
+	alerts := make(map[string][]Rule)
+	for _, rule := range c.Rules().Groups[1].Rules {
+		alerts[rule.Alert] = append(alerts[rule.Alert], rule)
+	}
+	expect := func(alert string, rule int, labels map[string]string) ExpectedAlert {
+		r := alerts[alert][rule]
+		all := map[string]string{}
+		for k, v := range labels {
+			all[k] = v
+		}
+		for k, v := range r.Labels {
+			all[k] = v
+		}
+		annotations := map[string]string{}
+		for k, v := range r.Annotations {
+			annotations[k] = expandLabels(v, all)
+		}
+		return ExpectedAlert{ExpLabels: all, ExpAnnotations: annotations}
+	}
+
+	// The default job is never stale before the default deadline, the jobs with an own deadline only after theirs.
+	stale := RuleTest{Name: "stale snapshots and sends", Interval: "1h"}
+	latest := c.Deadline
+	jobs := []jobDeadline{{job: "tank/default", deadline: c.Deadline}}
+	for _, jd := range c.JobDeadlines {
+		jobs = append(jobs, jd)
+		if jd.deadline > latest {
+			latest = jd.deadline
+		}
+	}
+	samples := int(latest.Hours()) + 2
+	for _, jd := range jobs {
+		stale.InputSeries = append(stale.InputSeries,
+			InputSeries{fmt.Sprintf(`%s_last_snapshot_success_timestamp_seconds{%s=%s}`, ns, ds, strconv.Quote(jd.job)), fmt.Sprintf("0x%d", samples)},
+			InputSeries{fmt.Sprintf(`%s_last_send_success_timestamp_seconds{%s=%s,target_host="remote"}`, ns, ds, strconv.Quote(jd.job)), fmt.Sprintf("0x%d", samples)},
+		)
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].deadline < jobs[j].deadline })
+	for _, jd := range jobs {
+		// Right before the deadline, only the jobs with a shorter deadline are stale.
+		before := promDuration(jd.deadline - time.Hour)
+		after := promDuration(jd.deadline + time.Hour)
+		for _, alert := range []string{"ZnapzendSnapshotStale", "ZnapzendSendStale"} {
+			stale.AlertRuleTest = append(stale.AlertRuleTest,
+				AlertRuleTest{EvalTime: before, Alertname: alert, ExpAlerts: c.staleAlerts(alert, jobs, jd.deadline-time.Hour, expect)},
+				AlertRuleTest{EvalTime: after, Alertname: alert, ExpAlerts: c.staleAlerts(alert, jobs, jd.deadline+time.Hour, expect)},
+			)
+		}
+	}
+
+	stuckSamples := int(c.StuckAfter/time.Hour) + 2
+	stuck := RuleTest{
+		Name:     "stuck send",
+		Interval: "1h",
+		InputSeries: []InputSeries{
+			{fmt.Sprintf(`%s_job_phase{%s="tank/stuck",target_host="remote",phase="presend"}`, ns, ds), fmt.Sprintf("1x%d", stuckSamples)},
+			{fmt.Sprintf(`%s_job_phase{%s="tank/done",target_host="remote",phase="presend"}`, ns, ds), fmt.Sprintf("1 0x%d", stuckSamples-1)},
+			{fmt.Sprintf(`%s_job_phase{%s="tank/silenced",target_host="remote",phase="presend"}`, ns, ds), fmt.Sprintf("1x%d", stuckSamples)},
+			{fmt.Sprintf(`%s_job_silenced{%s="tank/silenced"}`, ns, ds), fmt.Sprintf("1x%d", stuckSamples)},
+		},
+		AlertRuleTest: []AlertRuleTest{{
+			EvalTime:  promDuration(time.Duration(stuckSamples) * time.Hour),
+			Alertname: "ZnapzendPhaseStuck",
+			ExpAlerts: []ExpectedAlert{expect("ZnapzendPhaseStuck", 0, map[string]string{
+				ds: "tank/stuck", "target_host": "remote", "phase": "presend",
+			})},
+		}},
+	}
+
+	failures := RuleTest{
+		Name:     "failures",
+		Interval: "1m",
+		InputSeries: []InputSeries{
+			{fmt.Sprintf(`%s_orphaned_runs_total{%s="tank/data",phase="presend"}`, ns, ds), "0 1x10"},
+			{fmt.Sprintf(`%s_failed_runs_total{%s="tank/data",phase="presnap"}`, ns, ds), "0 1x10"},
+			{fmt.Sprintf(`%s_job_missed_runs_total{%s="tank/data",target_host=""}`, ns, ds), "0 1x10"},
+			{fmt.Sprintf(`%s_hook_calls_rejected_total{phase="presnap",reason="invalid_name"}`, ns), "0 1x10"},
+			{fmt.Sprintf(`up{job=%s}`, strconv.Quote(c.ScrapeJob)), "0x10"},
+		},
+		AlertRuleTest: []AlertRuleTest{{
+			EvalTime:  "5m",
+			Alertname: "ZnapzendRunOrphaned",
+			ExpAlerts: []ExpectedAlert{expect("ZnapzendRunOrphaned", 0, map[string]string{ds: "tank/data", "phase": "presend"})},
+		}, {
+			EvalTime:  "5m",
+			Alertname: "ZnapzendRunFailed",
+			ExpAlerts: []ExpectedAlert{expect("ZnapzendRunFailed", 0, map[string]string{ds: "tank/data", "phase": "presnap"})},
+		}, {
+			EvalTime:  "5m",
+			Alertname: "ZnapzendRunMissed",
+			ExpAlerts: []ExpectedAlert{expect("ZnapzendRunMissed", 0, map[string]string{ds: "tank/data"})},
+		}, {
+			EvalTime:  "5m",
+			Alertname: "ZnapzendHooksRejected",
+			ExpAlerts: []ExpectedAlert{expect("ZnapzendHooksRejected", 0, map[string]string{"phase": "presnap", "reason": "invalid_name"})},
+		}, {
+			EvalTime:  "3m",
+			Alertname: "ZnapzendExporterDown",
+			ExpAlerts: []ExpectedAlert{},
+		}, {
+			EvalTime:  "10m",
+			Alertname: "ZnapzendExporterDown",
+			ExpAlerts: []ExpectedAlert{expect("ZnapzendExporterDown", 0, map[string]string{"job": c.ScrapeJob})},
+		}},
+	}
+
+	return RuleTestFile{
+		RuleFiles:          []string{c.RulesFile},
+		EvaluationInterval: "1m",
+		Tests:              []RuleTest{stale, stuck, failures},
+	}
+}
+
+// staleAlerts returns the expected stale alerts of the jobs whose deadline has passed at the given time since the
+// last success.
+func (c RulesConfig) staleAlerts(alert string, jobs []jobDeadline, at time.Duration,
+	expect func(string, int, map[string]string) ExpectedAlert) []ExpectedAlert {
+	result := []ExpectedAlert{}
+	for _, jd := range jobs {
+		if jd.deadline >= at {
+			continue
+		}
+		// The rules of the jobs with an own deadline come first, the default rule last.
+		rule := len(c.JobDeadlines)
+		for i, own := range c.JobDeadlines {
+			if own.job == jd.job {
+				rule = i
+			}
+		}
+		labels := map[string]string{c.DatasetLabel: jd.job}
+		if alert == "ZnapzendSendStale" {
+			labels["target_host"] = "remote"
+		}
+		result = append(result, expect(alert, rule, labels))
+	}
+	return result
+}
+
+// expandLabels replaces the {{ $labels.name }} placeholders of an annotation with the given label values, as
+// Prometheus does when the alert fires.
+func expandLabels(text string, labels map[string]string) string {
+	return labelTemplatePattern.ReplaceAllStringFunc(text, func(match string) string {
+		return labels[labelTemplatePattern.FindStringSubmatch(match)[1]]
+	})
+}
+
+// promDuration formats the duration in the notation of Prometheus, e.g. "26h" or "1h30m".
+func promDuration(d time.Duration) string {
+	if d <= 0 {
+		return "0s"
+	}
+	var b strings.Builder
+	for _, unit := range []struct {
+		suffix string
+		length time.Duration
+	}{{"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}} {
+		if n := d / unit.length; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, unit.suffix)
+			d -= n * unit.length
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRulesConfig() RulesConfig {
+	return RulesConfig{
+		Namespace:    "znapzend",
+		DatasetLabel: "exported_job",
+		ScrapeJob:    "zfs",
+		Deadline:     26 * time.Hour,
+		JobDeadlines: []jobDeadline{{job: "tank/archive", deadline: 8 * 24 * time.Hour}, {job: "tank/hourly", deadline: 2 * time.Hour}},
+		StuckAfter:   6 * time.Hour,
+		RulesFile:    "rules.yml",
+	}
+}
+
+func TestRulesConfig_Rules(t *testing.T) {
+	b, err := yaml.Marshal(testRulesConfig().Rules())
+	require.NoError(t, err)
+	var rules RuleFile
+	require.NoError(t, yaml.Unmarshal(b, &rules))
+	require.Len(t, rules.Groups, 2)
+
+	exprs := make(map[string][]string)
+	for _, rule := range rules.Groups[1].Rules {
+		exprs[rule.Alert] = append(exprs[rule.Alert], rule.Expr)
+	}
+	assert.Equal(t, []string{`absent(up{job="zfs"} == 1)`}, exprs["ZnapzendExporterDown"])
+	assert.Equal(t, []string{
+		`znapzend:last_send_age_seconds{exported_job="tank/archive"} > 691200 unless on(exported_job, job) znapzend_job_silenced == 1`,
+		`znapzend:last_send_age_seconds{exported_job="tank/hourly"} > 7200 unless on(exported_job, job) znapzend_job_silenced == 1`,
+		`znapzend:last_send_age_seconds{exported_job!~"tank/archive|tank/hourly"} > 93600 unless on(exported_job, job) znapzend_job_silenced == 1`,
+	}, exprs["ZnapzendSendStale"])
+	assert.Equal(t, []string{`min_over_time(znapzend_job_phase{phase=~"presnap|presend"}[6h]) == 1 unless on(exported_job, job) znapzend_job_silenced == 1`},
+		exprs["ZnapzendPhaseStuck"])
+	for _, rule := range rules.Groups[1].Rules {
+		assert.NotEmpty(t, rule.Labels["severity"], rule.Alert)
+		assert.NotContains(t, rule.Annotations["summary"], "{{ $labels.job }}", rule.Alert)
+	}
+}
+
+func TestRulesConfig_unlessSilenced(t *testing.T) {
+	tests := []struct {
+		name         string
+		datasetLabel string
+		tenantLabel  string
+		expected     string
+	}{
+		{
+			name:         "GivenExportedJob_ThenMatchScrapeJob",
+			datasetLabel: "exported_job",
+			expected:     "up unless on(exported_job, job) znapzend_job_silenced == 1",
+		},
+		{
+			name:         "GivenHonorLabels_ThenMatchDataset",
+			datasetLabel: "job",
+			expected:     "up unless on(job) znapzend_job_silenced == 1",
+		},
+		{
+			name:         "GivenTenantLabel_ThenMatchSourceHost",
+			datasetLabel: "exported_job",
+			tenantLabel:  "source_host",
+			expected:     "up unless on(exported_job, job, source_host) znapzend_job_silenced == 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testRulesConfig()
+			cfg.DatasetLabel, cfg.TenantLabel = tt.datasetLabel, tt.tenantLabel
+			assert.Equal(t, tt.expected, cfg.unlessSilenced("up"))
+		})
+	}
+}
+
+func TestRulesConfig_Dashboard(t *testing.T) {
+	cfg := testRulesConfig()
+	cfg.Namespace = "backup"
+	b, err := json.Marshal(cfg.Dashboard())
+	require.NoError(t, err)
+	var dashboard struct {
+		Panels []struct {
+			ID      int
+			Targets []struct {
+				Expr         string
+				LegendFormat string
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(b, &dashboard))
+	require.NotEmpty(t, dashboard.Panels)
+	for i, panel := range dashboard.Panels {
+		assert.Equal(t, i+1, panel.ID)
+		for _, target := range panel.Targets {
+			assert.Contains(t, target.Expr, "backup_")
+			assert.NotContains(t, target.Expr, "znapzend")
+		}
+	}
+	assert.Contains(t, string(b), "{{exported_job}}")
+}
+
+func TestRulesConfig_Tests(t *testing.T) {
+	cfg := testRulesConfig()
+	tests := cfg.Tests()
+	assert.Equal(t, []string{"rules.yml"}, tests.RuleFiles)
+
+	alerts := make(map[string]bool)
+	for _, rule := range cfg.Rules().Groups[1].Rules {
+		alerts[rule.Alert] = true
+	}
+	firing := make(map[string]int)
+	for _, test := range tests.Tests {
+		for _, art := range test.AlertRuleTest {
+			assert.True(t, alerts[art.Alertname], art.Alertname)
+			_, err := time.ParseDuration(art.EvalTime)
+			assert.NoError(t, err)
+			for _, alert := range art.ExpAlerts {
+				firing[art.Alertname]++
+				assert.NotContains(t, alert.ExpAnnotations["summary"], "{{", art.Alertname)
+			}
+		}
+	}
+	for alert := range alerts {
+		assert.NotZero(t, firing[alert], "%s is never expected to fire", alert)
+	}
+
+	// 25h after the last success, only the job with the deadline of 2h is stale.
+	stale := tests.Tests[0].AlertRuleTest
+	i := 0
+	for ; i < len(stale) && stale[i].EvalTime != "25h"; i++ {
+	}
+	require.Less(t, i, len(stale))
+	require.Len(t, stale[i].ExpAlerts, 1)
+	assert.Equal(t, "tank/hourly", stale[i].ExpAlerts[0].ExpLabels["exported_job"])
+	assert.Equal(t, "The last snapshot of tank/hourly is older than 2h.", stale[i].ExpAlerts[0].ExpAnnotations["summary"])
+}
+
+func Test_runRulesCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rules")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	rules, tests := filepath.Join(dir, "znapzend-rules.yml"), filepath.Join(dir, "znapzend-rules-test.yml")
+	require.Zero(t, runRulesCommandTo(t, rules, "--jobDeadline", "tank/archive=192h"))
+	require.Zero(t, runRulesCommandTo(t, tests, "--output", "tests", "--jobDeadline", "tank/archive=192h"))
+
+	b, err := ioutil.ReadFile(rules)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `{{ $labels.exported_job }}`, "the dataset label is renamed by Prometheus by default")
+
+	promtool, err := exec.LookPath("promtool")
+	if err != nil {
+		t.Skip("promtool is not installed")
+	}
+	cmd := exec.Command(promtool, "test", "rules", tests)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(out))
+}
+
+// runRulesCommandTo runs the rules subcommand with its output written to the given file and returns its exit code.
+func runRulesCommandTo(t *testing.T, path string, args ...string) int {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() {
+		os.Stdout = stdout
+	}()
+	return runRulesCommand(args)
+}
+
+func Test_promDuration(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		expected string
+	}{
+		{0, "0s"},
+		{26 * time.Hour, "26h"},
+		{90 * time.Minute, "1h30m"},
+		{time.Hour + time.Second, "1h1s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			assert.Equal(t, tt.expected, promDuration(tt.duration))
+		})
+	}
+}
+
+func Test_expandLabels(t *testing.T) {
+	text := "{{ $labels.job }} to {{ $labels.target_host }}{{ $labels.missing }}"
+	assert.Equal(t, "tank to remote", expandLabels(text, map[string]string{"job": "tank", "target_host": "remote"}))
+	assert.True(t, strings.HasPrefix(expandLabels("{{ $value }}", nil), "{{"))
+}
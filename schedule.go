@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// scheduleCheckInterval is the interval in which the schedules are checked for missed runs.
+	scheduleCheckInterval = time.Minute
+)
+
+var (
+	// schedules contains the expected interval between two snapshots or sends by job name.
+	schedules = make(map[string]time.Duration)
+	// scheduleGrace is the duration a snapshot or send may finish late before it is counted as missed.
+	scheduleGrace = CreateDefaultConfig().Jobs.ScheduleGrace
+	// expectedRuns contains the next expected snapshot or send of the scheduled jobs by scheduleKey.
+	expectedRuns      = make(map[string]*expectedRun)
+	expectedRunsMutex sync.Mutex
+
+	planDurationPattern = regexp.MustCompile(`^(\d+)\s*([a-z]+)$`)
+	// planUnits contains the units of a znapzend plan by prefix, as znapzend accepts abbreviations like "min" or "h".
+	planUnits = []struct {
+		prefix string
+		length time.Duration
+	}{
+		{"y", 365 * 24 * time.Hour},
+		{"mo", 30 * 24 * time.Hour},
+		{"w", 7 * 24 * time.Hour},
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"mi", time.Minute},
+		{"s", time.Second},
+	}
+)
+
+type (
+	// expectedRun is the next snapshot (empty target host) or send of a scheduled job.
+	expectedRun struct {
+		job  Job
+		next time.Time
+	}
+)
+
+// parseSchedules parses a list of job=schedule pairs. The schedule is either a duration like "1h", or a znapzend plan
+// like "1day=>1hour,1week=>1day", of which the shortest interval is expected.
+func parseSchedules(values []string) (map[string]time.Duration, error) {
+	// The list has been split at the commas of the plans, so entries starting with a retention belong to the previous.
+	var pairs []string
+	for _, value := range values {
+		if arr := strings.SplitN(value, "=", 2); len(pairs) > 0 && len(arr) == 2 && strings.HasPrefix(arr[1], ">") {
+			pairs[len(pairs)-1] += "," + value
+			continue
+		}
+		pairs = append(pairs, value)
+	}
+	result := make(map[string]time.Duration)
+	for _, pair := range pairs {
+		arr := strings.SplitN(pair, "=", 2)
+		if len(arr) != 2 || arr[0] == "" {
+			return nil, fmt.Errorf("invalid schedule %q, expected job=schedule", pair)
+		}
+		interval, err := time.ParseDuration(arr[1])
+		if err != nil {
+			if interval, err = parsePlan(arr[1]); err != nil {
+				return nil, fmt.Errorf("invalid schedule of job %s: %v", arr[0], err)
+			}
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("invalid schedule of job %s: interval must be positive", arr[0])
+		}
+		name, err := normalizeJobName(arr[0])
+		if err != nil {
+			return nil, err
+		}
+		result[name] = interval
+	}
+	return result, nil
+}
+
+// parsePlan returns the shortest interval of a znapzend plan like "1day=>1hour,1week=>1day".
+func parsePlan(plan string) (time.Duration, error) {
+	var shortest time.Duration
+	for _, entry := range strings.Split(plan, ",") {
+		arr := strings.Split(entry, "=>")
+		if len(arr) != 2 {
+			return 0, fmt.Errorf("invalid plan entry %q, expected retention=>interval", entry)
+		}
+		interval, err := parsePlanDuration(arr[1])
+		if err != nil {
+			return 0, err
+		}
+		if shortest == 0 || interval < shortest {
+			shortest = interval
+		}
+	}
+	return shortest, nil
+}
+
+// parsePlanDuration parses a duration of a znapzend plan like "1hour", "30min" or "7d".
+func parsePlanDuration(value string) (time.Duration, error) {
+	match := planDurationPattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(value)))
+	if match == nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	n, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, err
+	}
+	for _, unit := range planUnits {
+		if strings.HasPrefix(match[2], unit.prefix) {
+			return time.Duration(n) * unit.length, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown unit of duration %q", value)
+}
+
+// expectRun expects the next snapshot (empty target host) or send of the job one interval after the given time, if the
+// job is scheduled. If once is set, an already expected run is kept.
+func (p *Job) expectRun(target string, after time.Time, once bool) {
+	interval, scheduled := schedules[p.JobName]
+	if !scheduled {
+		return
+	}
+	job := *p
+	job.TargetHost = target
+	key := scheduleKey(job)
+	expectedRunsMutex.Lock()
+	defer expectedRunsMutex.Unlock()
+	if _, exists := expectedRuns[key]; exists && once {
+		return
+	}
+	run := &expectedRun{job: job, next: after.Add(interval)}
+	expectedRuns[key] = run
+	run.publish()
+}
+
+// ObserveSchedule expects the next run of a scheduled job after its snapshot or send has finished.
+func (p *Job) ObserveSchedule(phase Phase) {
+	switch phase {
+	case PhasePostSnap:
+		p.expectRun("", p.at(), false)
+	case PhasePostSend:
+		p.expectRun(p.TargetHost, p.at(), false)
+	}
+}
+
+// forgetSchedule stops expecting the runs of the job, or only the sends to the target host if TargetHost is set.
+func (p *Job) forgetSchedule() {
+	expectedRunsMutex.Lock()
+	defer expectedRunsMutex.Unlock()
+	delete(expectedRuns, scheduleKey(*p))
+}
+
+// RunScheduleCheck counts the missed runs of the scheduled jobs until stop is closed.
+func RunScheduleCheck(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			checkSchedules(now)
+		}
+	}
+}
+
+// checkSchedules counts every window of a scheduled job that has passed by the given time without a finished snapshot or
+// send, unless the job has been silenced, and expects the next run one interval later. Returns the number of missed
+// runs.
+func checkSchedules(now time.Time) int {
+	missed := 0
+	hookMutex.Lock()
+	defer hookMutex.Unlock()
+	expectedRunsMutex.Lock()
+	defer expectedRunsMutex.Unlock()
+	for _, run := range expectedRuns {
+		interval := schedules[run.job.JobName]
+		if interval <= 0 {
+			continue
+		}
+		for deadline := run.next.Add(scheduleGrace); now.After(deadline); deadline = run.next.Add(scheduleGrace) {
+			// Runs that are missed during maintenance are expected.
+			if !isSilenced(run.job, deadline) {
+				incCounter(missedRunsMetric, run.job.labelValues(run.job.TargetHost), nil)
+				run.job.logger().WithField("expected", run.next).Warn("Scheduled run has been missed.")
+				missed++
+			}
+			run.next = run.next.Add(interval)
+		}
+		run.publish()
+	}
+	return missed
+}
+
+// publish sets the gauge of the next expected run. expectedRunsMutex has to be held.
+func (r *expectedRun) publish() {
+	setTimestamp(nextExpectedMetric, r.job.labelValues(r.job.TargetHost), r.next)
+}
+
+// scheduleKey returns the key of the expected runs of the job and its target host.
+func scheduleKey(job Job) string {
+	return job.SourceHost + "|" + job.JobName + "|" + job.TargetHost
+}
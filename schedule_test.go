@@ -0,0 +1,130 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_parseSchedules(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []string
+		expected map[string]time.Duration
+		wantErr  bool
+	}{
+		{name: "Duration", values: []string{"tank/data=90m"}, expected: map[string]time.Duration{"tank/data": 90 * time.Minute}},
+		{name: "Plan", values: []string{"tank/data=1day=>1hour,7days=>1day"}, expected: map[string]time.Duration{"tank/data": time.Hour}},
+		{name: "PlanSplitAtCommas", values: []string{"tank/data=7days=>1day", "1day=>15min", "tank/other=168h"},
+			expected: map[string]time.Duration{"tank/data": 15 * time.Minute, "tank/other": 7 * 24 * time.Hour}},
+		{name: "TrailingSlash", values: []string{"tank/data/=1h"}, expected: map[string]time.Duration{"tank/data": time.Hour}},
+		{name: "MissingSchedule", values: []string{"tank/data"}, wantErr: true},
+		{name: "UnknownUnit", values: []string{"tank/data=1day=>1fortnight"}, wantErr: true},
+		{name: "ZeroInterval", values: []string{"tank/data=0s"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseSchedules(tt.values)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func Test_parsePlanDuration(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"30seconds", 30 * time.Second},
+		{"10min", 10 * time.Minute},
+		{"1hour", time.Hour},
+		{"2 days", 48 * time.Hour},
+		{"1week", 7 * 24 * time.Hour},
+		{"6months", 180 * 24 * time.Hour},
+		{"1year", 365 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			result, err := parsePlanDuration(tt.value)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func Test_checkSchedules(t *testing.T) {
+	schedules = map[string]time.Duration{"tank/scheduled": time.Hour}
+	job := Job{JobName: "tank/scheduled", TargetHost: "remote"}
+	defer func() {
+		job.TargetHost = ""
+		job.UnregisterMetric()
+		schedules = make(map[string]time.Duration)
+	}()
+	require.NoError(t, job.RegisterMetric())
+	start := time.Now()
+	snapshot, send := []string{"tank/scheduled", ""}, []string{"tank/scheduled", "remote"}
+	next := testutil.ToFloat64(nextExpectedMetric.WithLabelValues(snapshot...))
+	assert.InDelta(t, float64(start.Add(time.Hour).Unix()), next, 2)
+
+	assert.Zero(t, checkSchedules(start.Add(time.Hour+scheduleGrace-time.Minute)))
+	// Both the snapshot and the send missed the first and second window.
+	assert.Equal(t, 4, checkSchedules(start.Add(2*time.Hour+scheduleGrace+time.Minute)))
+	assert.EqualValues(t, 2, testutil.ToFloat64(missedRunsMetric.WithLabelValues(snapshot...)))
+	assert.EqualValues(t, 2, testutil.ToFloat64(missedRunsMetric.WithLabelValues(send...)))
+	assert.InDelta(t, next+2*3600, testutil.ToFloat64(nextExpectedMetric.WithLabelValues(snapshot...)), 1)
+
+	r := SetupRouter()
+	for _, query := range []string{"/presnap/tank/scheduled", "/postsnap/tank/scheduled"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", query, nil))
+	}
+	assert.InDelta(t, float64(time.Now().Add(time.Hour).Unix()), testutil.ToFloat64(nextExpectedMetric.WithLabelValues(snapshot...)), 2)
+	assert.Zero(t, checkSchedules(time.Now().Add(time.Hour+scheduleGrace-time.Minute)))
+	assert.EqualValues(t, 2, testutil.ToFloat64(missedRunsMetric.WithLabelValues(snapshot...)))
+
+	job.TargetHost = ""
+	job.UnregisterMetric()
+	assert.Zero(t, checkSchedules(start.Add(24*time.Hour)))
+	assert.False(t, missedRunsMetric.DeleteLabelValues(send...))
+}
+
+func TestStateStore_Apply_WhenReplicatedRunFinished_ThenExpectNextRun(t *testing.T) {
+	schedules = map[string]time.Duration{"tank/replicated": time.Hour}
+	// Hide the jobs of other tests from the eviction.
+	knownDatasetsMutex.Lock()
+	previous := knownDatasets
+	knownDatasets = make(map[string]map[string]*datasetSeries)
+	knownDatasetsMutex.Unlock()
+	job := Job{JobName: "tank/replicated", TargetHost: "remote"}
+	defer func() {
+		job.TargetHost = ""
+		job.UnregisterMetric()
+		schedules = make(map[string]time.Duration)
+		knownDatasetsMutex.Lock()
+		knownDatasets = previous
+		knownDatasetsMutex.Unlock()
+	}()
+	require.NoError(t, job.RegisterMetric())
+	finished := time.Now().Add(30 * time.Minute)
+	s := NewStateStore(&recordingBackend{})
+
+	require.True(t, s.Apply(StateEntry{Gauge: gaugeSnapshotState, Labels: []string{"tank/replicated"},
+		Value: JobStateDone, Updated: finished}))
+	require.True(t, s.Apply(StateEntry{Gauge: gaugeSendState, Labels: []string{"tank/replicated", "remote"},
+		Value: JobStateDone, Updated: finished}))
+	send := []string{"tank/replicated", "remote"}
+	assert.InDelta(t, float64(finished.Add(time.Hour).Unix()),
+		testutil.ToFloat64(nextExpectedMetric.WithLabelValues(send...)), 1)
+	assert.Zero(t, checkSchedules(finished.Add(time.Hour+scheduleGrace-time.Minute)),
+		"the runs finished on another replica are not missed")
+
+	assert.Zero(t, evictSeries(finished.Add(24*time.Hour)), "scheduled jobs are not evicted")
+	assert.True(t, isKnownDataset(Job{JobName: "tank/replicated"}))
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// LimitMaxJobs is the limit of the number of jobs of all source hosts.
+	LimitMaxJobs = "max_jobs"
+	// LimitMaxTargets is the limit of the number of target hosts per job.
+	LimitMaxTargets = "max_targets"
+)
+
+var (
+	// limitsConfig contains the limits of the number of series.
+	limitsConfig = CreateDefaultConfig().Limits
+	// knownDatasets contains the registered or hooked jobs by source host and job name.
+	knownDatasets      = make(map[string]map[string]*datasetSeries)
+	knownDatasetsMutex sync.Mutex
+)
+
+type (
+	// datasetSeries tracks when the series of a job and its target hosts have been updated the last time, and whether
+	// the job has been registered at startup or through the API.
+	datasetSeries struct {
+		touched    time.Time
+		targets    map[string]time.Time
+		registered bool
+	}
+	// labelDeleter is implemented by all metric vectors.
+	labelDeleter interface {
+		DeleteLabelValues(values ...string) bool
+	}
+	// datasetInfo describes a known job and its target hosts.
+	datasetInfo struct {
+		Job        string    `json:"job"`
+		SourceHost string    `json:"source_host,omitempty"`
+		Targets    []string  `json:"targets"`
+		Updated    time.Time `json:"updated"`
+	}
+	// seriesLimitError is returned if a job or target host would exceed the configured limits.
+	seriesLimitError struct {
+		error
+		limit string
+	}
+)
+
+// rememberDataset adds the job and its target host to the known datasets, so that it is found as a child by recursive
+// hooks and is not evicted. Returns a seriesLimitError if the job or target host is new and the limit has been reached.
+func rememberDataset(job Job) error {
+	return addDataset(job, false)
+}
+
+// registerDataset adds the job like rememberDataset, but keeps it from being evicted until it is unregistered, as
+// registered jobs make up the allow-list.
+func registerDataset(job Job) error {
+	return addDataset(job, true)
+}
+
+// addDataset adds the job and its target host to the known datasets and marks the job as registered if requested.
+func addDataset(job Job, registered bool) error {
+	knownDatasetsMutex.Lock()
+	defer knownDatasetsMutex.Unlock()
+	entry, found := knownDatasets[job.SourceHost][job.JobName]
+	if !found {
+		if limitsConfig.MaxJobs > 0 && countDatasets() >= limitsConfig.MaxJobs {
+			seriesRejectedMetric.WithLabelValues(LimitMaxJobs).Inc()
+			return seriesLimitError{fmt.Errorf("limit of %d jobs reached", limitsConfig.MaxJobs), LimitMaxJobs}
+		}
+		entry = &datasetSeries{targets: make(map[string]time.Time)}
+	}
+	if _, knownTarget := entry.targets[job.TargetHost]; job.TargetHost != "" && !knownTarget {
+		if limitsConfig.MaxTargets > 0 && len(entry.targets) >= limitsConfig.MaxTargets {
+			seriesRejectedMetric.WithLabelValues(LimitMaxTargets).Inc()
+			return seriesLimitError{fmt.Errorf("limit of %d target hosts reached for job %s",
+				limitsConfig.MaxTargets, job.JobName), LimitMaxTargets}
+		}
+	}
+	now := time.Now()
+	entry.touched = now
+	entry.registered = entry.registered || registered
+	if job.TargetHost != "" {
+		entry.targets[job.TargetHost] = now
+	}
+	if knownDatasets[job.SourceHost] == nil {
+		knownDatasets[job.SourceHost] = make(map[string]*datasetSeries)
+	}
+	knownDatasets[job.SourceHost][job.JobName] = entry
+	return nil
+}
+
+// forgetDataset removes the job from the known datasets. If TargetHost is set, only the target host is removed.
+// Returns the removed target hosts, sorted by name.
+func forgetDataset(job Job) []string {
+	knownDatasetsMutex.Lock()
+	defer knownDatasetsMutex.Unlock()
+	entry, found := knownDatasets[job.SourceHost][job.JobName]
+	if !found {
+		return nil
+	}
+	if job.TargetHost != "" {
+		if _, knownTarget := entry.targets[job.TargetHost]; !knownTarget {
+			return nil
+		}
+		delete(entry.targets, job.TargetHost)
+		return []string{job.TargetHost}
+	}
+	targets := make([]string, 0, len(entry.targets))
+	for target := range entry.targets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	delete(knownDatasets[job.SourceHost], job.JobName)
+	return targets
+}
+
+// isKnownDataset returns true if the job has been registered or called before.
+func isKnownDataset(job Job) bool {
+	knownDatasetsMutex.Lock()
+	defer knownDatasetsMutex.Unlock()
+	_, found := knownDatasets[job.SourceHost][job.JobName]
+	return found
+}
+
+// isKnownTarget returns true if the job and its target host have been registered or called before. Returns the same as
+// isKnownDataset if TargetHost is empty.
+func isKnownTarget(job Job) bool {
+	knownDatasetsMutex.Lock()
+	defer knownDatasetsMutex.Unlock()
+	entry, found := knownDatasets[job.SourceHost][job.JobName]
+	if !found || job.TargetHost == "" {
+		return found
+	}
+	_, found = entry.targets[job.TargetHost]
+	return found
+}
+
+// listDatasets returns the known jobs with their target hosts, sorted by source host and name.
+func listDatasets() []datasetInfo {
+	knownDatasetsMutex.Lock()
+	defer knownDatasetsMutex.Unlock()
+	result := []datasetInfo{}
+	for source, datasets := range knownDatasets {
+		for name, entry := range datasets {
+			result = append(result, entry.info(source, name))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].SourceHost != result[j].SourceHost {
+			return result[i].SourceHost < result[j].SourceHost
+		}
+		return result[i].Job < result[j].Job
+	})
+	return result
+}
+
+// describeDataset returns the job with its target hosts, or false if the job is not known.
+func describeDataset(job Job) (datasetInfo, bool) {
+	knownDatasetsMutex.Lock()
+	defer knownDatasetsMutex.Unlock()
+	entry, found := knownDatasets[job.SourceHost][job.JobName]
+	if !found {
+		return datasetInfo{}, false
+	}
+	return entry.info(job.SourceHost, job.JobName), true
+}
+
+// info returns the description of the entry. knownDatasetsMutex has to be held.
+func (d *datasetSeries) info(source, name string) datasetInfo {
+	targets := make([]string, 0, len(d.targets))
+	for target := range d.targets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return datasetInfo{Job: name, SourceHost: source, Targets: targets, Updated: d.touched}
+}
+
+// children returns a copy of the job for each known descendant dataset of the same source host, sorted by name.
+func (p *Job) children() []Job {
+	prefix := p.JobName + "/"
+	knownDatasetsMutex.Lock()
+	var names []string
+	for name := range knownDatasets[p.SourceHost] {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	knownDatasetsMutex.Unlock()
+	sort.Strings(names)
+	result := make([]Job, len(names))
+	for i, name := range names {
+		result[i] = *p
+		result[i].JobName = name
+	}
+	return result
+}
+
+// countDatasets returns the number of known jobs of all source hosts. knownDatasetsMutex has to be held.
+func countDatasets() int {
+	count := 0
+	for _, jobs := range knownDatasets {
+		count += len(jobs)
+	}
+	return count
+}
+
+// RunEviction evicts the series that have not been updated within the given TTL until stop is closed.
+func RunEviction(ttl time.Duration, stop <-chan struct{}) {
+	interval := ttl / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			evictSeries(now.Add(-ttl))
+		}
+	}
+}
+
+// evictSeries deletes all series of the jobs and target hosts that have not been updated since the given time, except
+// of the registered and scheduled jobs. Returns the number of deleted series.
+func evictSeries(before time.Time) int {
+	var jobs, targets []Job
+	knownDatasetsMutex.Lock()
+	for source, datasets := range knownDatasets {
+		for name, entry := range datasets {
+			// Registered jobs are kept, so that they are still accepted in allow-list mode, and scheduled jobs, so that
+			// their missed runs are still counted after they stopped running.
+			if _, scheduled := schedules[name]; scheduled || entry.registered {
+				continue
+			}
+			job := Job{SourceHost: source, JobName: name}
+			for target, touched := range entry.targets {
+				if entry.touched.Before(before) || touched.Before(before) {
+					job.TargetHost = target
+					targets = append(targets, job)
+					delete(entry.targets, target)
+				}
+			}
+			if entry.touched.Before(before) {
+				job.TargetHost = ""
+				jobs = append(jobs, job)
+				delete(datasets, name)
+			}
+		}
+	}
+	knownDatasetsMutex.Unlock()
+
+	evicted := func() int {
+		hookMutex.Lock()
+		defer hookMutex.Unlock()
+		evicted := 0
+		for _, job := range targets {
+			before := job.auditGauges()
+			evicted += job.deleteTargetSeries()
+			audit.RecordSystem(job, AuditResultEvicted, before, job.auditGauges())
+		}
+		for _, job := range jobs {
+			before := job.auditGauges()
+			evicted += job.deleteJobSeries()
+			audit.RecordSystem(job, AuditResultEvicted, before, job.auditGauges())
+		}
+		return evicted
+	}()
+
+	if evicted > 0 {
+		seriesEvictedMetric.Add(float64(evicted))
+		log.WithFields(log.Fields{"jobs": len(jobs), "targets": len(targets), "series": evicted}).Info("Evicted stale series.")
+	}
+	return evicted
+}
+
+// deleteJobSeries deletes the series of the job that are not labelled by target host, and forgets the latest events of
+// the job and its target hosts, its started runs, expected snapshots and silence. Returns the number of deleted series.
+func (p *Job) deleteJobSeries() int {
+	gauges := []*prometheus.GaugeVec{preSnapMetric, postSnapMetric, snapshotStateMetric, lastSnapshotMetric}
+	deleted := deleteSeries(p.labelValues(), gauges, snapshotDurationMetric, jobSilencedMetric)
+	for _, phase := range []Phase{PhasePreSnap, PhasePostSnap, PhasePreSend, PhasePostSend} {
+		deleted += deleteSeries(p.labelValues(string(phase)), nil, hookCallsMetric, orphanedRunsMetric, failedRunsMetric)
+	}
+	for _, phase := range jobPhases {
+		deleted += deleteSeries(p.labelValues("", string(phase)), []*prometheus.GaugeVec{jobPhaseMetric})
+	}
+	deleted += deleteSeries(p.labelValues(""), nil, nextExpectedMetric, missedRunsMetric)
+	latestEventsMutex.Lock()
+	for key := range latestEvents {
+		if key == p.jobKey() || strings.HasPrefix(key, p.jobKey()+"|") {
+			delete(latestEvents, key)
+		}
+	}
+	latestEventsMutex.Unlock()
+	p.forgetRuns()
+	p.forgetSchedule()
+	p.forgetSilence()
+	return deleted
+}
+
+// deleteTargetSeries deletes the series of the target host of the job and forgets its latest event, started and
+// expected sends and their progress.
+// Returns the number of deleted series.
+func (p *Job) deleteTargetSeries() int {
+	gauges := []*prometheus.GaugeVec{preSendMetric, postSendMetric, sendStateMetric, lastSendMetric}
+	deleted := deleteSeries(p.labelValues(p.TargetHost), gauges, sendDurationMetric, nextExpectedMetric, missedRunsMetric)
+	for _, phase := range jobPhases {
+		deleted += deleteSeries(p.labelValues(p.TargetHost, string(phase)), []*prometheus.GaugeVec{jobPhaseMetric})
+	}
+	deleted += p.resetProgress()
+	latestEventsMutex.Lock()
+	delete(latestEvents, p.eventKey(PhasePreSend))
+	latestEventsMutex.Unlock()
+	p.forgetRuns()
+	p.forgetSchedule()
+	return deleted
+}
+
+// forgetRuns drops the started runs of the job, or only the sends to the target host if TargetHost is set, so that
+// they are not counted as orphaned.
+func (p *Job) forgetRuns() {
+	runStartsMutex.Lock()
+	defer runStartsMutex.Unlock()
+	for key, runs := range runStarts {
+		if len(runs) == 0 {
+			continue
+		}
+		// All runs of a key belong to the same job, phase and target host.
+		run := runs[0]
+		if run.job.SourceHost != p.SourceHost || run.job.JobName != p.JobName {
+			continue
+		}
+		if p.TargetHost != "" && (run.phase != PhasePreSend || run.job.TargetHost != p.TargetHost) {
+			continue
+		}
+		delete(runStarts, key)
+	}
+}
+
+// deleteSeries deletes the series with the given label values from the gauges, whose deletion is shared with other
+// replicas, and from the other vectors. Returns the number of deleted series.
+func deleteSeries(values []string, gauges []*prometheus.GaugeVec, vecs ...labelDeleter) int {
+	deleted := 0
+	for _, vec := range gauges {
+		if deleteGauge(vec, values) {
+			deleted++
+		}
+	}
+	for _, vec := range vecs {
+		if gauge, ok := vec.(*prometheus.GaugeVec); ok {
+			untrackGauge(gauge, values)
+		}
+		if vec.DeleteLabelValues(values...) {
+			deleted++
+		}
+	}
+	return deleted
+}
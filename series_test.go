@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSeriesLimits(t *testing.T) {
+	knownDatasetsMutex.Lock()
+	limitsConfig = LimitsMap{MaxJobs: countDatasets() + 1, MaxTargets: 1}
+	knownDatasetsMutex.Unlock()
+	defer func() {
+		limitsConfig = CreateDefaultConfig().Limits
+		for _, name := range []string{"limited", "unlimited"} {
+			job := Job{JobName: name}
+			job.UnregisterMetric()
+		}
+	}()
+	r := SetupRouter()
+	get := func(query string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", query, nil))
+		return w.Code
+	}
+	rejectedJobs := testutil.ToFloat64(seriesRejectedMetric.WithLabelValues(LimitMaxJobs))
+	rejectedTargets := testutil.ToFloat64(seriesRejectedMetric.WithLabelValues(LimitMaxTargets))
+
+	assert.Equal(t, http.StatusOK, get("/presend/limited?TargetHost=host"))
+	assert.Equal(t, http.StatusOK, get("/postsend/limited?TargetHost=host"))
+	assert.Equal(t, http.StatusUnprocessableEntity, get("/presend/limited?TargetHost=other"))
+	assert.Equal(t, http.StatusUnprocessableEntity, get("/presnap/unlimited"))
+	assert.Equal(t, http.StatusUnprocessableEntity, get("/register/unlimited"))
+
+	assert.EqualValues(t, rejectedJobs+2, testutil.ToFloat64(seriesRejectedMetric.WithLabelValues(LimitMaxJobs)))
+	assert.EqualValues(t, rejectedTargets+1, testutil.ToFloat64(seriesRejectedMetric.WithLabelValues(LimitMaxTargets)))
+	assert.False(t, isKnownDataset(Job{JobName: "unlimited"}))
+}
+
+func Test_evictSeries(t *testing.T) {
+	// Hide the jobs of other tests from the eviction.
+	knownDatasetsMutex.Lock()
+	previous := knownDatasets
+	knownDatasets = make(map[string]map[string]*datasetSeries)
+	knownDatasetsMutex.Unlock()
+	job := Job{JobName: "stale"}
+	defer func() {
+		job.UnregisterMetric()
+		knownDatasetsMutex.Lock()
+		knownDatasets = previous
+		knownDatasetsMutex.Unlock()
+	}()
+	r := SetupRouter()
+	for _, query := range []string{"/presnap/stale", "/postsnap/stale", "/presend/stale?TargetHost=host"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", query, nil))
+	}
+	evicted := testutil.ToFloat64(seriesEvictedMetric)
+
+	assert.Zero(t, evictSeries(time.Now().Add(-time.Hour)))
+	// presnap, postsnap, snapshot state, last snapshot, snapshot duration, 3 hook counters, 6 job phases, and presend,
+	// postsend, send state and 6 job phases of the target host.
+	assert.Equal(t, 23, evictSeries(time.Now().Add(time.Second)))
+	assert.EqualValues(t, evicted+23, testutil.ToFloat64(seriesEvictedMetric))
+	assert.False(t, isKnownDataset(job))
+	assert.False(t, preSnapMetric.DeleteLabelValues("stale"))
+	assert.False(t, preSendMetric.DeleteLabelValues("stale", "host"))
+}
+
+func Test_evictSeries_Registered(t *testing.T) {
+	knownDatasetsMutex.Lock()
+	previous := knownDatasets
+	knownDatasets = make(map[string]map[string]*datasetSeries)
+	knownDatasetsMutex.Unlock()
+	hooksConfig.AllowList = true
+	job := Job{JobName: "allowed", TargetHost: "host"}
+	defer func() {
+		hooksConfig = CreateDefaultConfig().Hooks
+		job.UnregisterMetric()
+		knownDatasetsMutex.Lock()
+		knownDatasets = previous
+		knownDatasetsMutex.Unlock()
+	}()
+	require.NoError(t, job.RegisterMetric())
+	r := SetupRouter()
+	get := func(query string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", query, nil))
+		return w.Code
+	}
+
+	assert.Zero(t, evictSeries(time.Now().Add(time.Hour)), "registered jobs are not evicted")
+	assert.Equal(t, http.StatusOK, get("/presnap/allowed"))
+	assert.Equal(t, http.StatusOK, get("/presend/allowed?TargetHost=host"))
+	unregistered := Job{JobName: "allowed"}
+	unregistered.UnregisterMetric()
+	assert.Equal(t, http.StatusNotFound, get("/presnap/allowed"))
+}
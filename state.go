@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// StateBackendFile shares the state through a file on a shared volume.
+	StateBackendFile = "file"
+	// StateBackendGossip shares the state by sending changes to all peers via HTTP.
+	StateBackendGossip = "gossip"
+)
+
+var (
+	// state is nil unless a state backend is configured, in which case the gauges are shared between replicas.
+	state *StateStore
+)
+
+type (
+	// StateEntry is the shared value of a single gauge.
+	StateEntry struct {
+		Gauge   Phase     `json:"gauge"`
+		Labels  []string  `json:"labels"`
+		Value   float64   `json:"value"`
+		ResetAt time.Time `json:"reset_at"`
+		Deleted bool      `json:"deleted,omitempty"`
+		Updated time.Time `json:"updated"`
+	}
+	// StateBackend distributes the state entries between replicas.
+	StateBackend interface {
+		// Publish shares the given entry, which has been changed by this replica, with the other replicas.
+		Publish(entry StateEntry) error
+		// Sync receives the entries of the other replicas and passes them to apply.
+		Sync(apply func(StateEntry)) error
+	}
+	// StateStore keeps the latest entry of each gauge and applies changes of other replicas to the local gauges.
+	// Conflicts are resolved by the last write.
+	StateStore struct {
+		backend StateBackend
+		mu      sync.Mutex
+		entries map[string]StateEntry
+	}
+)
+
+// NewStateBackend creates the state backend from the given config.
+func NewStateBackend(cfg StateMap) (StateBackend, error) {
+	switch cfg.Backend {
+	case StateBackendFile:
+		return NewFileStateBackend(cfg.Path)
+	case StateBackendGossip:
+		if cfg.Token == "" {
+			return nil, errors.New("token of the replicas is required for the gossip backend")
+		}
+		return NewGossipStateBackend(cfg.Peers, cfg.Token), nil
+	default:
+		return nil, fmt.Errorf("unknown state backend: %s", cfg.Backend)
+	}
+}
+
+// NewStateStore creates a new StateStore with the given backend.
+func NewStateStore(backend StateBackend) *StateStore {
+	return &StateStore{backend: backend, entries: make(map[string]StateEntry)}
+}
+
+// Sync applies the entries received from the backend once and prunes the deleted entries that are older than
+// stateTombstoneTTL. The entries are applied while holding hookMutex, so that they do not interleave with hooks, but
+// received before, so that hooks are not blocked by a slow backend.
+func (s *StateStore) Sync() {
+	var received []StateEntry
+	err := s.backend.Sync(func(entry StateEntry) {
+		received = append(received, entry)
+	})
+	if err != nil {
+		log.WithError(err).Warn("Could not sync state.")
+	}
+	hookMutex.Lock()
+	defer hookMutex.Unlock()
+	for _, entry := range received {
+		s.applyAudited(entry, func(job Job, before, after map[Phase]*float64) {
+			audit.RecordPeer(job, AuditResultReplicated, before, after)
+		})
+	}
+	s.prune(time.Now())
+}
+
+// applyAudited applies the entry like Apply and, if it has been applied, passes the job and the value of the gauge
+// before and after to record. Returns true if the entry has been applied.
+func (s *StateStore) applyAudited(entry StateEntry, record func(job Job, before, after map[Phase]*float64)) bool {
+	vec := gaugeByName(entry.Gauge)
+	var before *float64
+	if vec != nil {
+		before = gaugeValue(vec, entry.Labels)
+	}
+	if !s.Apply(entry) {
+		return false
+	}
+	after := gaugeValue(vec, entry.Labels)
+	record(entry.job(), map[Phase]*float64{entry.Gauge: before}, map[Phase]*float64{entry.Gauge: after})
+	return true
+}
+
+// prune drops the deleted entries that have not been updated within stateTombstoneTTL, as the deletion has reached
+// all replicas by then.
+func (s *StateStore) prune(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.entries {
+		if entry.Deleted && now.Sub(entry.Updated) >= stateTombstoneTTL {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// Run syncs the state in the given interval until stop is closed.
+func (s *StateStore) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.Sync()
+		}
+	}
+}
+
+// Known returns true if an entry for the gauge with the given label values exists that is not deleted. Always returns
+// false if the StateStore is nil.
+func (s *StateStore) Known(vec *prometheus.GaugeVec, values []string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, found := s.entries[StateEntry{Gauge: gaugeName(vec), Labels: values}.key()]
+	return found && !entry.Deleted
+}
+
+// Record stores the given entry that has been changed locally and publishes it. Does nothing if the StateStore is nil.
+func (s *StateStore) Record(entry StateEntry) {
+	if s == nil {
+		return
+	}
+	entry.Updated = time.Now()
+	s.mu.Lock()
+	s.entries[entry.key()] = entry
+	s.mu.Unlock()
+	if err := s.backend.Publish(entry); err != nil {
+		log.WithField("gauge", entry.Gauge).WithError(err).Warn("Could not publish state.")
+	}
+}
+
+// Apply sets the local gauge to the value of the given entry, unless a newer entry is already known. Returns true if
+// the entry has been applied.
+func (s *StateStore) Apply(entry StateEntry) bool {
+	vec := gaugeByName(entry.Gauge)
+	if vec == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, found := s.entries[entry.key()]; found && !entry.Updated.After(existing.Updated) {
+		return false
+	}
+	if entry.Deleted {
+		vec.DeleteLabelValues(entry.Labels...)
+		untrackGauge(vec, entry.Labels)
+		s.entries[entry.key()] = entry
+		return true
+	}
+	gauge, err := vec.GetMetricWithLabelValues(entry.Labels...)
+	if err != nil {
+		log.WithField("labels", entry.Labels).WithError(err).Warn("Could not apply state, are the labels of all replicas configured the same?")
+		return false
+	}
+	s.entries[entry.key()] = entry
+	trackGauge(vec, entry.Labels, gauge)
+	if !entry.ResetAt.IsZero() {
+		if delay := time.Until(entry.ResetAt); delay > 0 {
+			gauge.Set(entry.Value)
+			scheduleReset(gauge, entry.Labels, delay)
+		} else {
+			gauge.Set(0)
+		}
+		return true
+	}
+	gauge.Set(entry.Value)
+	entry.observeSchedule()
+	return true
+}
+
+// observeSchedule expects the next run of a scheduled job after another replica has finished its snapshot or send, so
+// that the replicas agree on the missed runs. s.mu has to be held.
+func (e StateEntry) observeSchedule() {
+	if e.Value != JobStateDone {
+		return
+	}
+	job := e.job()
+	switch e.Gauge {
+	case gaugeSnapshotState:
+		job.expectRun("", e.Updated, false)
+	case gaugeSendState:
+		job.expectRun(job.TargetHost, e.Updated, false)
+	}
+}
+
+// Entries returns all known entries, sorted by the time of the update.
+func (s *StateStore) Entries() []StateEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]StateEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Updated.Before(result[j].Updated)
+	})
+	return result
+}
+
+func (e StateEntry) key() string {
+	return string(e.Gauge) + "|" + strings.Join(e.Labels, "|")
+}
+
+// job returns the job whose gauge is changed by the entry, with the target host for the gauges labelled by it and the
+// source host in multi-tenant mode.
+func (e StateEntry) job() Job {
+	var job Job
+	if len(e.Labels) > 0 {
+		job.JobName = e.Labels[0]
+	}
+	// The derived labels follow the dataset, the target host and the phase.
+	derived := 1
+	switch e.Gauge {
+	case PhasePreSend, PhasePostSend, gaugeSendState, gaugeLastSend:
+		derived = 2
+	case gaugeJobPhase:
+		derived = 3
+	}
+	if derived > 1 && len(e.Labels) > 1 {
+		job.TargetHost = e.Labels[1]
+	}
+	if sourceHostLabeled && len(e.Labels) > derived {
+		job.SourceHost = e.Labels[derived]
+	}
+	return job
+}
+
+func handleGetState(context *gin.Context) {
+	if !authorizeState(context) {
+		return
+	}
+	SetLogLevel(context, log.DebugLevel)
+	context.JSON(http.StatusOK, state.Entries())
+}
+
+func handlePostState(context *gin.Context) {
+	if !authorizeState(context) {
+		return
+	}
+	var entries []StateEntry
+	if err := context.ShouldBindJSON(&entries); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	applied := 0
+	hookMutex.Lock()
+	defer hookMutex.Unlock()
+	for _, entry := range entries {
+		if state.applyAudited(entry, func(job Job, before, after map[Phase]*float64) {
+			audit.Record(context, job, AuditResultReplicated, before, after)
+		}) {
+			applied++
+		}
+	}
+	SetLogWithFields(context, log.DebugLevel, "Applied state of peer.", log.Fields{"applied": applied})
+	context.JSON(http.StatusOK, gin.H{"applied": applied})
+}
+
+// authorizeState verifies that the state is shared via gossip and the request carries the shared token of the peers.
+func authorizeState(context *gin.Context) bool {
+	if state == nil {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "state is not shared"})
+		return false
+	}
+	backend, ok := state.backend.(*GossipStateBackend)
+	if !ok {
+		context.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "state is not shared via gossip"})
+		return false
+	}
+	if !backend.authorized(context.Request) {
+		context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		return false
+	}
+	context.Set(identityKey, identityPeer)
+	return true
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// stateCompactSize is the size of the state file above which it is compacted, once it has doubled since the last
+	// compaction.
+	stateCompactSize = 1 << 20
+	// stateTombstoneTTL is the duration for which deleted entries are kept when the state file is compacted, and in the
+	// state store.
+	stateTombstoneTTL = 24 * time.Hour
+	// stateLockTimeout is the age after which the lock of a compaction is considered abandoned, e.g. after a crash.
+	stateLockTimeout = time.Minute
+)
+
+type (
+	// FileStateBackend shares the state through a JSON lines file on a volume that is mounted by all replicas.
+	// Changes are appended to the file, and each replica polls the file for the changes of the others. As the file
+	// is read from the beginning at startup, it also persists the state across restarts. Once the file has grown, it is
+	// replaced by a compacted file containing only the latest entry of each gauge.
+	FileStateBackend struct {
+		path   string
+		mu     sync.Mutex
+		offset int64
+		// file identifies the file that has been read up to offset, in order to detect a compaction by another replica.
+		file os.FileInfo
+		// compacted is the size of the file after the last compaction.
+		compacted int64
+	}
+)
+
+// NewFileStateBackend creates a new FileStateBackend. The file is created if it does not exist.
+func NewFileStateBackend(path string) (*FileStateBackend, error) {
+	if path == "" {
+		return nil, errors.New("path of the state file is required")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStateBackend{path: path}, f.Close()
+}
+
+// Publish appends the entry to the file. If the file has been replaced by a compaction in the meantime, the entry is
+// appended to the new file as well.
+func (b *FileStateBackend) Publish(entry StateEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	written, err := appendToFile(b.path, line)
+	if err != nil {
+		return err
+	}
+	if current, err := os.Stat(b.path); err == nil && !os.SameFile(written, current) {
+		_, err = appendToFile(b.path, line)
+		return err
+	}
+	return nil
+}
+
+// appendToFile appends the data to the file at the given path and returns the file info of the file written to.
+func appendToFile(path string, data []byte) (os.FileInfo, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// A single write with O_APPEND keeps the lines of concurrent writers intact.
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return info, f.Close()
+}
+
+// Sync applies all complete lines that have been appended since the last sync. If the file has been replaced by a
+// compaction, it is read from the beginning. The file is compacted once it has grown enough.
+func (b *FileStateBackend) Sync(apply func(StateEntry)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if b.file != nil && !os.SameFile(b.file, info) {
+		// Entries that have already been applied are ignored, as they are not newer than the known ones.
+		b.offset, b.compacted = 0, info.Size()
+	}
+	b.file = info
+	if _, err := f.Seek(b.offset, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// An incomplete line is still being written, it is read again with the next sync.
+			break
+		}
+		if err != nil {
+			return err
+		}
+		b.offset += int64(len(line))
+		entry := StateEntry{}
+		if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+			log.WithField("path", b.path).WithError(err).Warn("Skipping invalid line in state file.")
+			continue
+		}
+		apply(entry)
+	}
+	if b.offset > stateCompactSize && b.offset > 2*b.compacted {
+		if err := b.compact(time.Now()); err != nil {
+			log.WithField("path", b.path).WithError(err).Warn("Could not compact state file.")
+		}
+	}
+	return nil
+}
+
+// compact replaces the file with a file that contains only the latest entry of each gauge, dropping deleted entries
+// after stateTombstoneTTL. Lines that other replicas append during the compaction are carried over to the new file.
+// Only one replica compacts at a time, the others skip the compaction. b.mu has to be held.
+func (b *FileStateBackend) compact(now time.Time) error {
+	lock := b.path + ".lock"
+	l, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		if info, err := os.Stat(lock); err == nil && now.Sub(info.ModTime()) > stateLockTimeout {
+			return os.Remove(lock)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer os.Remove(lock)
+	if err := l.Close(); err != nil {
+		return err
+	}
+
+	old, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	latest := make(map[string]StateEntry)
+	reader := bufio.NewReader(old)
+	var read int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		read += int64(len(line))
+		entry := StateEntry{}
+		if json.Unmarshal(bytes.TrimSpace(line), &entry) != nil {
+			continue
+		}
+		if existing, found := latest[entry.key()]; !found || !entry.Updated.Before(existing.Updated) {
+			latest[entry.key()] = entry
+		}
+	}
+	entries := make([]StateEntry, 0, len(latest))
+	for _, entry := range latest {
+		if !entry.Deleted || now.Sub(entry.Updated) < stateTombstoneTTL {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Updated.Before(entries[j].Updated)
+	})
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	tmp := b.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		return err
+	}
+
+	// Lines appended after reading are only in the old file. Incomplete lines are published again by their writer,
+	// which notices that the file has been replaced.
+	if _, err := old.Seek(read, io.SeekStart); err != nil {
+		return err
+	}
+	tail, err := ioutil.ReadAll(old)
+	if err != nil {
+		return err
+	}
+	if i := bytes.LastIndexByte(tail, '\n'); i >= 0 {
+		if _, err := appendToFile(b.path, tail[:i+1]); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{"path": b.path, "before": read, "after": buf.Len()}).Info("Compacted state file.")
+	// The new file is read from the beginning with the next sync.
+	b.file, b.offset, b.compacted = nil, 0, int64(buf.Len())
+	return nil
+}
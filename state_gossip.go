@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type (
+	// GossipStateBackend shares the state by POSTing each change to the /state endpoint of all peers. In order to
+	// catch up on missed changes, e.g. after a restart, the full state of the peers is pulled with each sync.
+	GossipStateBackend struct {
+		peers  []string
+		token  string
+		client *http.Client
+	}
+)
+
+// NewGossipStateBackend creates a new GossipStateBackend. The peers are given as base URLs, e.g. http://replica-2:8080.
+func NewGossipStateBackend(peers []string, token string) *GossipStateBackend {
+	return &GossipStateBackend{
+		peers:  peers,
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Publish sends the entry to all peers in the background.
+func (b *GossipStateBackend) Publish(entry StateEntry) error {
+	payload, err := json.Marshal([]StateEntry{entry})
+	if err != nil {
+		return err
+	}
+	for _, peer := range b.peers {
+		go func(peer string) {
+			if err := b.send(http.MethodPost, peer, payload, nil); err != nil {
+				log.WithField("peer", peer).WithError(err).Warn("Could not publish state to peer.")
+			}
+		}(peer)
+	}
+	return nil
+}
+
+// Sync pulls the full state of all peers. Unreachable peers are skipped.
+func (b *GossipStateBackend) Sync(apply func(StateEntry)) error {
+	for _, peer := range b.peers {
+		var entries []StateEntry
+		if err := b.send(http.MethodGet, peer, nil, &entries); err != nil {
+			log.WithField("peer", peer).WithError(err).Debug("Could not pull state from peer.")
+			continue
+		}
+		for _, entry := range entries {
+			apply(entry)
+		}
+	}
+	return nil
+}
+
+func (b *GossipStateBackend) send(method, peer string, payload []byte, result interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(peer, "/")+"/state", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// authorized returns true if the request carries the shared token. Requests are never authorized without token.
+func (b *GossipStateBackend) authorized(req *http.Request) bool {
+	if b.token == "" {
+		return false
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(b.token)) == 1
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingBackend struct {
+	published []StateEntry
+	received  []StateEntry
+}
+
+func (b *recordingBackend) Publish(entry StateEntry) error {
+	b.published = append(b.published, entry)
+	return nil
+}
+
+func (b *recordingBackend) Sync(apply func(StateEntry)) error {
+	for _, entry := range b.received {
+		apply(entry)
+	}
+	return nil
+}
+
+func TestStateStore_Apply(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		entries  []StateEntry
+		expected float64
+	}{
+		{
+			name: "GivenNewerEntry_ThenApply",
+			entries: []StateEntry{
+				{Gauge: PhasePreSnap, Labels: []string{"state"}, Value: 0, Updated: now},
+				{Gauge: PhasePreSnap, Labels: []string{"state"}, Value: 1, Updated: now.Add(time.Second)},
+			},
+			expected: 1,
+		},
+		{
+			name: "GivenOlderEntry_ThenIgnore",
+			entries: []StateEntry{
+				{Gauge: PhasePreSnap, Labels: []string{"state"}, Value: 1, Updated: now},
+				{Gauge: PhasePreSnap, Labels: []string{"state"}, Value: 0, Updated: now.Add(-time.Second)},
+			},
+			expected: 1,
+		},
+		{
+			name: "GivenEntryWithPastReset_ThenApplyReset",
+			entries: []StateEntry{
+				{Gauge: PhasePreSnap, Labels: []string{"state"}, Value: 1, Updated: now, ResetAt: now.Add(-time.Second)},
+			},
+			expected: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStateStore(&recordingBackend{})
+			for _, entry := range tt.entries {
+				s.Apply(entry)
+			}
+			assert.EqualValues(t, tt.expected, testutil.ToFloat64(preSnapMetric.WithLabelValues("state")))
+			preSnapMetric.DeleteLabelValues("state")
+		})
+	}
+}
+
+func TestStateStore_Sync(t *testing.T) {
+	now := time.Now()
+	backend := &recordingBackend{received: []StateEntry{
+		{Gauge: PhasePreSnap, Labels: []string{"synced"}, Value: 1, Updated: now},
+		{Gauge: PhasePreSnap, Labels: []string{"expired"}, Deleted: true, Updated: now.Add(-2 * stateTombstoneTTL)},
+		{Gauge: PhasePreSnap, Labels: []string{"deleted"}, Deleted: true, Updated: now.Add(-time.Hour)},
+	}}
+	s := NewStateStore(backend)
+	defer preSnapMetric.DeleteLabelValues("synced")
+
+	s.Sync()
+	assert.EqualValues(t, 1, testutil.ToFloat64(preSnapMetric.WithLabelValues("synced")))
+	var labels []string
+	for _, entry := range s.Entries() {
+		labels = append(labels, entry.Labels[0])
+	}
+	assert.ElementsMatch(t, []string{"synced", "deleted"}, labels, "tombstones are pruned after the TTL")
+}
+
+func TestStateStore_Record(t *testing.T) {
+	backend := &recordingBackend{}
+	state = NewStateStore(backend)
+	defer func() {
+		state = nil
+		j := Job{JobName: "state"}
+		j.UnregisterMetric()
+	}()
+
+	j := Job{JobName: "state"}
+	require.NoError(t, j.RegisterMetric())
+	j.setMetric(postSnapMetric)
+	published := len(backend.published)
+	require.NoError(t, j.RegisterMetric())
+
+	require.Len(t, backend.published, published, "register must not overwrite known gauges")
+	assert.Equal(t, PhasePostSnap, backend.published[published-1].Gauge)
+	assert.True(t, state.Known(postSnapMetric, []string{"state"}))
+	assert.True(t, state.Known(jobPhaseMetric, []string{"state", "", string(PhaseUnknown)}))
+}
+
+func TestStateStore_Record_LastSuccess(t *testing.T) {
+	backend := &recordingBackend{}
+	state = NewStateStore(backend)
+	j := Job{JobName: "replicated-success"}
+	defer func() {
+		state = nil
+		j.UnregisterMetric()
+	}()
+	r := SetupRouter()
+	finished := time.Now().Add(-time.Minute).Truncate(time.Second)
+	timestamp := strconv.FormatInt(finished.Unix(), 10)
+	for _, query := range []string{"/postsnap/replicated-success?Timestamp=" + timestamp,
+		"/postsend/replicated-success?TargetHost=host&Timestamp=" + timestamp} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", query, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	var published []StateEntry
+	for _, entry := range backend.published {
+		if entry.Gauge == gaugeLastSnapshot || entry.Gauge == gaugeLastSend {
+			published = append(published, entry)
+		}
+	}
+	require.Len(t, published, 2)
+
+	// Another replica applies the times of success with the job and target host they belong to.
+	lastSnapshotMetric.DeleteLabelValues("replicated-success")
+	lastSendMetric.DeleteLabelValues("replicated-success", "host")
+	replica := NewStateStore(&recordingBackend{})
+	for _, entry := range published {
+		assert.Equal(t, j.JobName, entry.job().JobName)
+		replica.Apply(entry)
+	}
+	assert.Equal(t, "host", published[1].job().TargetHost)
+	assert.EqualValues(t, finished.Unix(), testutil.ToFloat64(lastSnapshotMetric.WithLabelValues("replicated-success")))
+	assert.EqualValues(t, finished.Unix(), testutil.ToFloat64(lastSendMetric.WithLabelValues("replicated-success", "host")))
+}
+
+func TestFileStateBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.jsonl")
+
+	writer, err := NewFileStateBackend(path)
+	require.NoError(t, err)
+	reader, err := NewFileStateBackend(path)
+	require.NoError(t, err)
+
+	var received []StateEntry
+	apply := func(entry StateEntry) {
+		received = append(received, entry)
+	}
+	require.NoError(t, writer.Publish(StateEntry{Gauge: PhasePreSend, Labels: []string{"tank", "host"}, Value: 1}))
+	require.NoError(t, reader.Sync(apply))
+	require.NoError(t, writer.Publish(StateEntry{Gauge: PhasePostSend, Labels: []string{"tank", "host"}, Value: 1}))
+
+	// An incomplete line must not be consumed until it is finished.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"gauge":"presnap"`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, reader.Sync(apply))
+	require.Len(t, received, 2)
+	assert.Equal(t, PhasePreSend, received[0].Gauge)
+	assert.Equal(t, PhasePostSend, received[1].Gauge)
+}
+
+func TestFileStateBackend_compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.jsonl")
+	writer, err := NewFileStateBackend(path)
+	require.NoError(t, err)
+	reader, err := NewFileStateBackend(path)
+	require.NoError(t, err)
+	now := time.Now()
+
+	for _, entry := range []StateEntry{
+		{Gauge: PhasePreSend, Labels: []string{"tank", "host"}, Value: 1, Updated: now.Add(-time.Minute)},
+		{Gauge: PhasePreSend, Labels: []string{"tank", "host"}, Value: 0, Updated: now},
+		{Gauge: PhasePreSnap, Labels: []string{"evicted"}, Deleted: true, Updated: now.Add(-2 * stateTombstoneTTL)},
+		{Gauge: PhasePreSnap, Labels: []string{"deleted"}, Deleted: true, Updated: now.Add(-time.Second)},
+	} {
+		require.NoError(t, writer.Publish(entry))
+	}
+	var received []StateEntry
+	apply := func(entry StateEntry) {
+		received = append(received, entry)
+	}
+	require.NoError(t, reader.Sync(apply))
+	require.Len(t, received, 4)
+
+	require.NoError(t, writer.compact(now))
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(b), "\n"), "only the latest entries and recent deletions are kept")
+	_, err = os.Stat(path + ".lock")
+	assert.True(t, os.IsNotExist(err))
+
+	require.NoError(t, writer.Publish(StateEntry{Gauge: PhasePostSnap, Labels: []string{"tank"}, Value: 1, Updated: now}))
+	received = nil
+	require.NoError(t, reader.Sync(apply))
+	require.Len(t, received, 3, "the compacted file is read from the beginning")
+	assert.Equal(t, []string{"deleted"}, received[0].Labels)
+	assert.Equal(t, PhasePreSend, received[1].Gauge)
+	assert.Zero(t, received[1].Value)
+	assert.Equal(t, PhasePostSnap, received[2].Gauge)
+
+	// Another replica is compacting.
+	require.NoError(t, ioutil.WriteFile(path+".lock", nil, 0644))
+	require.NoError(t, writer.compact(now))
+	b, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(b), "\n"))
+}
+
+func TestNewStateBackend_WhenGossipWithoutToken_ThenReturnError(t *testing.T) {
+	_, err := NewStateBackend(StateMap{Backend: StateBackendGossip, Peers: []string{"http://replica-2:8080"}})
+	assert.Error(t, err)
+	assert.False(t, NewGossipStateBackend(nil, "").authorized(httptest.NewRequest("POST", "/state", nil)))
+}
+
+func TestGossipStateBackend(t *testing.T) {
+	peerStore := NewStateStore(NewGossipStateBackend(nil, "secret"))
+	state = peerStore
+	defer func() {
+		state = nil
+		preSnapMetric.DeleteLabelValues("gossip")
+	}()
+	peer := httptest.NewServer(SetupRouter())
+	defer peer.Close()
+
+	backend := NewGossipStateBackend([]string{peer.URL}, "secret")
+	require.NoError(t, backend.Publish(StateEntry{
+		Gauge: PhasePreSnap, Labels: []string{"gossip"}, Value: 1, Updated: time.Now(),
+	}))
+	assert.Eventually(t, func() bool {
+		return peerStore.Known(preSnapMetric, []string{"gossip"})
+	}, time.Second, 10*time.Millisecond)
+
+	var received []StateEntry
+	require.NoError(t, backend.Sync(func(entry StateEntry) {
+		received = append(received, entry)
+	}))
+	require.Len(t, received, 1)
+	assert.Equal(t, []string{"gossip"}, received[0].Labels)
+
+	resp, err := http.Post(peer.URL+"/state", "application/json", strings.NewReader("[]"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
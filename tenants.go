@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	// tenants is nil unless the multi-tenant mode is enabled, in which case the source host of each hook is resolved.
+	tenants *TenantResolver
+)
+
+type (
+	// TenantResolver identifies the znapzend host that calls a hook in multi-tenant mode.
+	TenantResolver struct {
+		tokens   map[string]string
+		networks []tenantNetwork
+		// allowUnauthenticated accepts an explicit source host that has neither a token nor an address mapping.
+		allowUnauthenticated bool
+	}
+	tenantNetwork struct {
+		host    string
+		network *net.IPNet
+	}
+	// tenantError is returned when a source host could not be resolved, including the HTTP status code to respond with.
+	tenantError struct {
+		status int
+		error
+	}
+)
+
+// NewTenantResolver creates a new TenantResolver from the given config. Returns an error if the tokens or addresses
+// cannot be parsed.
+func NewTenantResolver(cfg TenantsMap) (*TenantResolver, error) {
+	tokens, err := parseLabelPairs(cfg.Tokens)
+	if err != nil {
+		return nil, err
+	}
+	r := &TenantResolver{tokens: tokens, allowUnauthenticated: cfg.AllowUnauthenticated}
+	for _, pair := range cfg.Addresses {
+		arr := strings.SplitN(pair, "=", 2)
+		if len(arr) != 2 || arr[0] == "" {
+			return nil, fmt.Errorf("invalid address mapping, expected host=ip or host=cidr: %s", pair)
+		}
+		network, err := parseNetwork(arr[1])
+		if err != nil {
+			return nil, err
+		}
+		r.networks = append(r.networks, tenantNetwork{host: arr[0], network: network})
+	}
+	return r, nil
+}
+
+// parseNetwork parses an IP address or a network in CIDR notation. A single address is returned as network of this
+// address only.
+func parseNetwork(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	return network, err
+}
+
+// Resolve returns the source host of the given request. A source host with a configured token can only be used by
+// presenting the token as bearer token. Otherwise the source host is taken from the client address mapping. An explicit
+// SourceHost parameter without token or address mapping is only accepted if unauthenticated source hosts are allowed.
+// If the caller has been authenticated by token or address, the identity is stored in the context, e.g. "token:host".
+func (r *TenantResolver) Resolve(c *gin.Context, explicit string) (string, error) {
+	if token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "); token != "" {
+		host := r.hostByToken(token)
+		if host == "" {
+			return "", tenantError{http.StatusUnauthorized, errors.New("invalid token")}
+		}
+		c.Set(identityKey, "token:"+host)
+		return r.verifyExplicit(host, explicit)
+	}
+	host := r.hostByIP(clientAddress(c))
+	if host != "" {
+		host, err := r.verifyExplicit(host, explicit)
+		if err == nil && r.tokens[host] != "" {
+			return "", tenantError{http.StatusUnauthorized, fmt.Errorf("token required for source host %s", host)}
+		}
+		c.Set(identityKey, "address:"+host)
+		return host, err
+	}
+	if explicit == "" {
+		return "", tenantError{http.StatusBadRequest, errors.New("missing SourceHost parameter in query")}
+	}
+	if r.tokens[explicit] != "" {
+		return "", tenantError{http.StatusUnauthorized, fmt.Errorf("token required for source host %s", explicit)}
+	}
+	if !r.allowUnauthenticated || r.isMapped(explicit) {
+		return "", tenantError{http.StatusUnauthorized, fmt.Errorf("source host %s has not been authenticated", explicit)}
+	}
+	return explicit, nil
+}
+
+// isMapped returns true if the source host has an address mapping.
+func (r *TenantResolver) isMapped(host string) bool {
+	for _, n := range r.networks {
+		if n.host == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *TenantResolver) verifyExplicit(host, explicit string) (string, error) {
+	if explicit != "" && explicit != host {
+		return "", tenantError{http.StatusForbidden, fmt.Errorf("not allowed to act on behalf of source host %s", explicit)}
+	}
+	return host, nil
+}
+
+func (r *TenantResolver) hostByToken(token string) string {
+	for host, t := range r.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return host
+		}
+	}
+	return ""
+}
+
+func (r *TenantResolver) hostByIP(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	for _, n := range r.networks {
+		if n.network.Contains(ip) {
+			return n.host
+		}
+	}
+	return ""
+}
+
+// TenantHandle returns a Gin handler that resolves the source host of the parsed parameters in multi-tenant mode.
+// Does nothing if the multi-tenant mode is disabled or no parameters have been parsed.
+func TenantHandle() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, exists := c.Get(parameterKey)
+		if tenants == nil || !exists {
+			return
+		}
+		job := value.(Job)
+		host, err := tenants.Resolve(c, job.SourceHost)
+		if err != nil {
+			status := http.StatusBadRequest
+			if te, ok := err.(tenantError); ok {
+				status = te.status
+			}
+			countRejectedHook(c, RejectReasonTenant)
+			c.AbortWithStatusJSON(status, gin.H{
+				"error": err.Error(),
+			})
+			SetLogWithFields(c, log.WarnLevel, "Could not resolve source host.", log.Fields{"error": err})
+			return
+		}
+		job.SourceHost = host
+		c.Set(parameterKey, job)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenantHandle(t *testing.T) {
+	cfg := CreateDefaultConfig()
+	cfg.Tenants = TenantsMap{
+		Enabled:   true,
+		Label:     "source_host",
+		Tokens:    []string{"nas-1=secret-1", "nas-2=secret-2"},
+		Addresses: []string{"nas-3=203.0.113.0/24", "nas-1=198.51.100.1"},
+	}
+	require.NoError(t, SetupMetrics(cfg))
+	resolver, err := NewTenantResolver(cfg.Tenants)
+	require.NoError(t, err)
+	tenants = resolver
+	defer func() {
+		tenants = nil
+		require.NoError(t, SetupMetrics(CreateDefaultConfig()))
+	}()
+
+	tests := []struct {
+		name                 string
+		query                string
+		token                string
+		remoteAddr           string
+		forwardedFor         string
+		allowUnauthenticated bool
+		expectedStatus       int
+		expectedHost         string
+	}{
+		{
+			name:           "GivenToken_WhenValid_ThenUseHostOfToken",
+			query:          "/presnap/tank",
+			token:          "secret-1",
+			expectedStatus: http.StatusOK,
+			expectedHost:   "nas-1",
+		},
+		{
+			name:           "GivenToken_WhenInvalid_ThenUnauthorized",
+			query:          "/presnap/tank",
+			token:          "wrong",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "GivenToken_WhenSourceHostOfOtherHost_ThenForbidden",
+			query:          "/presnap/tank?SourceHost=nas-2",
+			token:          "secret-1",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "GivenSourceHost_WhenHostHasToken_ThenUnauthorized",
+			query:          "/presnap/tank?SourceHost=nas-2",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "GivenSourceHost_WhenHostHasNoToken_ThenUnauthorized",
+			query:          "/presnap/tank?SourceHost=nas-4",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:                 "GivenSourceHost_WhenUnauthenticatedAllowed_ThenUseSourceHost",
+			query:                "/presnap/tank?SourceHost=nas-4",
+			allowUnauthenticated: true,
+			expectedStatus:       http.StatusOK,
+			expectedHost:         "nas-4",
+		},
+		{
+			name:                 "GivenSourceHost_WhenHostIsMappedToOtherAddress_ThenUnauthorized",
+			query:                "/presnap/tank?SourceHost=nas-3",
+			allowUnauthenticated: true,
+			expectedStatus:       http.StatusUnauthorized,
+		},
+		{
+			name:           "GivenClientIP_WhenMapped_ThenUseHostOfAddress",
+			query:          "/presnap/tank",
+			remoteAddr:     "203.0.113.10:1234",
+			expectedStatus: http.StatusOK,
+			expectedHost:   "nas-3",
+		},
+		{
+			name:           "GivenClientIP_WhenMappedHostHasToken_ThenUnauthorized",
+			query:          "/presnap/tank",
+			remoteAddr:     "198.51.100.1:1234",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "GivenForwardedFor_WhenUntrustedPeer_ThenIgnoreHeader",
+			query:          "/presnap/tank",
+			forwardedFor:   "203.0.113.10",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "GivenForwardedFor_WhenTrustedProxy_ThenUseForwardedAddress",
+			query:          "/presnap/tank",
+			remoteAddr:     "10.0.0.2:1234",
+			forwardedFor:   "198.51.100.99, 203.0.113.10, 10.0.0.3",
+			expectedStatus: http.StatusOK,
+			expectedHost:   "nas-3",
+		},
+		{
+			name:           "GivenNoIdentity_ThenBadRequest",
+			query:          "/presnap/tank",
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+	trustedProxies = []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+	defer func() {
+		trustedProxies = nil
+	}()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver.allowUnauthenticated = tt.allowUnauthenticated
+			req := httptest.NewRequest("GET", tt.query, nil)
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			w := httptest.NewRecorder()
+			SetupRouter().ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedHost != "" {
+				assert.EqualValues(t, 1, testutil.ToFloat64(preSnapMetric.WithLabelValues("tank", tt.expectedHost)))
+			}
+		})
+	}
+}
+
+func Test_parseJobSpec(t *testing.T) {
+	tests := []struct {
+		spec           string
+		withSourceHost bool
+		expected       Job
+	}{
+		{spec: "tank/data", withSourceHost: true, expected: Job{JobName: "tank/data"}},
+		{spec: "tank/data@remote", withSourceHost: true, expected: Job{JobName: "tank/data", TargetHost: "remote"}},
+		{spec: "nas-1:tank/data@remote", withSourceHost: true,
+			expected: Job{JobName: "tank/data", TargetHost: "remote", SourceHost: "nas-1"}},
+		{spec: "tank/data:backup@remote", expected: Job{JobName: "tank/data:backup", TargetHost: "remote"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			assert.Equal(t, tt.expected, parseJobSpec(tt.spec, tt.withSourceHost))
+		})
+	}
+}